@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	sdk "github.com/newsworthy39/golang-clouddom-sdk"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// reasonCircuitOpen is recorded for a request, the breaker turned away.
+const reasonCircuitOpen = "circuit open"
+
+// breakerResult is how a request, allowed by the breaker, went.
+type breakerResult int
+
+const (
+	breakerIgnored breakerResult = iota
+	breakerSuccess
+	breakerFailure
+)
+
+// breakerTicket is handed out by Allow, for the request to report its
+// result with. Results of requests allowed before the last change of
+// state are ignored, and while half-open, only the trials count.
+type breakerTicket struct {
+	epoch int64
+	trial bool
+}
+
+// BreakerSettings of a CircuitBreaker. Zero Failures disables it.
+type BreakerSettings struct {
+	Failures         int
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+// CircuitBreaker stops requests to a backend, after Failures in a row.
+// Once open, requests fail fast for OpenDuration, after which it is
+// half-open, and lets HalfOpenRequests trial requests through. When they
+// all succeed it closes, if any fails it opens again. It is shared by
+// every ProxyTargetRule, using the same backend and settings.
+type CircuitBreaker struct {
+	sync.Mutex
+	Backend   string
+	Settings  BreakerSettings
+	apiConfig *sdk.APIContext
+	state     string
+	failures  int
+	openUntil time.Time
+	trials    int
+	successes int
+	epoch     int64
+	stats     BreakerStats
+}
+
+// BreakerStats counts the transitions of a CircuitBreaker, for monitoring.
+type BreakerStats struct {
+	Backend    string
+	State      string
+	Opened     int64
+	HalfOpened int64
+	Closed     int64
+	Rejected   int64
+}
+
+// breakers are shared by backend and settings.
+var breakers = newRegistry[*CircuitBreaker](nil)
+
+// NewBreakerSettings enables the breaker, when the route or the backend
+// configures one; the fields the backend sets win over the route.
+func NewBreakerSettings(route *BreakerConfig, backend *BreakerConfig) BreakerSettings {
+	var settings BreakerSettings
+	if route == nil && backend == nil {
+		return settings
+	}
+
+	settings = BreakerSettings{Failures: 5, OpenDuration: 10 * time.Second, HalfOpenRequests: 1}
+	for _, config := range []*BreakerConfig{route, backend} {
+		if config == nil {
+			continue
+		}
+		if config.Failures > 0 {
+			settings.Failures = config.Failures
+		}
+		if config.OpenDuration > 0 {
+			settings.OpenDuration = time.Duration(config.OpenDuration) * time.Millisecond
+		}
+		if config.HalfOpenRequests > 0 {
+			settings.HalfOpenRequests = config.HalfOpenRequests
+		}
+	}
+	return settings
+}
+
+// breakerFor returns the breaker of the backend, creating it on first use.
+func breakerFor(apiConfig *sdk.APIContext, backend string, settings BreakerSettings) *CircuitBreaker {
+	key := fmt.Sprintf("%s %+v", backend, settings)
+	return breakers.get(key, func() *CircuitBreaker {
+		return &CircuitBreaker{Backend: backend, Settings: settings, apiConfig: apiConfig,
+			state: BreakerClosed}
+	})
+}
+
+// Allow reports if a request may go to the backend, and how long until it
+// may be tried again, when not. Every allowed request must be followed by
+// Done, with the ticket.
+func (b *CircuitBreaker) Allow() (breakerTicket, bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == BreakerOpen {
+		if wait := time.Until(b.openUntil); wait > 0 {
+			b.stats.Rejected++
+			return breakerTicket{}, false, wait
+		}
+		b.transition(BreakerHalfOpen, "open duration passed")
+	}
+
+	ticket := breakerTicket{epoch: b.epoch}
+	if b.state == BreakerHalfOpen {
+		if b.trials >= b.Settings.HalfOpenRequests {
+			b.stats.Rejected++
+			return breakerTicket{}, false, b.Settings.OpenDuration
+		}
+		b.trials++
+		ticket.trial = true
+	}
+	return ticket, true, 0
+}
+
+// Done records the result of an allowed request.
+func (b *CircuitBreaker) Done(ticket breakerTicket, result breakerResult) {
+	b.Lock()
+	defer b.Unlock()
+
+	if ticket.epoch != b.epoch {
+		return
+	}
+
+	switch b.state {
+	case BreakerClosed:
+		switch result {
+		case breakerSuccess:
+			b.failures = 0
+		case breakerFailure:
+			b.failures++
+			if b.failures >= b.Settings.Failures {
+				b.transition(BreakerOpen, fmt.Sprintf("%d failures in a row", b.failures))
+			}
+		}
+
+	case BreakerHalfOpen:
+		if !ticket.trial {
+			return
+		}
+		switch result {
+		case breakerIgnored:
+			// Give the trial to the next request.
+			if b.trials > 0 {
+				b.trials--
+			}
+		case breakerSuccess:
+			b.successes++
+			if b.successes >= b.Settings.HalfOpenRequests {
+				b.transition(BreakerClosed, fmt.Sprintf("%d trial requests succeeded", b.successes))
+			}
+		case breakerFailure:
+			b.transition(BreakerOpen, "trial request failed")
+		}
+	}
+}
+
+// transition changes the state, logging it, and sending it as an event.
+// Called with the lock held.
+func (b *CircuitBreaker) transition(state string, reason string) {
+	b.state = state
+	b.failures, b.trials, b.successes = 0, 0, 0
+	b.epoch++
+
+	switch state {
+	case BreakerOpen:
+		b.openUntil = time.Now().Add(b.Settings.OpenDuration)
+		b.stats.Opened++
+	case BreakerHalfOpen:
+		b.stats.HalfOpened++
+	case BreakerClosed:
+		b.stats.Closed++
+	}
+
+	log.Printf("Circuit breaker of %s is %s, %s\n", b.Backend, state, reason)
+	sendEvent(b.apiConfig, 1004, fmt.Sprintf("CircuitBreaker %s %s: %s", b.Backend, state, reason))
+}
+
+// State returns the current state.
+func (b *CircuitBreaker) State() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) Stats() BreakerStats {
+	b.Lock()
+	defer b.Unlock()
+	stats := b.stats
+	stats.Backend, stats.State = b.Backend, b.state
+	return stats
+}
+
+// AllBreakerStats returns the stats of every breaker, ordered by backend.
+func AllBreakerStats() []BreakerStats {
+	stats := make([]BreakerStats, 0)
+	for _, breaker := range breakers.values() {
+		stats = append(stats, breaker.Stats())
+	}
+	return stats
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	sdk "github.com/newsworthy39/golang-clouddom-sdk"
+)
+
+// Route is the loadbalancers view of a route. It embeds the sdk.Route, and
+// adds the options the sdk does not know about. They are read from the same
+// JSON-document as the sdk.Route, and are zero when loaded from the REST-api.
+type Route struct {
+	sdk.Route
+
+	// Hosts this route answers for, matched against the Host-header.
+	// Either exact (api.example.com), wildcard subdomains (*.example.com),
+	// or the catch-all (*). A host with a port, only matches that port.
+	// When Hosts is set, Path holds the path only, otherwise Path is
+	// scheme://host/path.
+	Hosts []string
+
+	// Predicate, when set, sends matching requests to PredicateBackends,
+	// and everything else to Backends.
+	Predicate         *PredicateConfig
+	PredicateBackends []sdk.Backend
+
+	// StripPrefix removes the prefix matched by Path, before proxying.
+	StripPrefix bool
+
+	// Rewrite rewrites path and host, before proxying.
+	Rewrite *RewriteConfig
+
+	// AllowHeaders, when set, are the only end-to-end headers forwarded,
+	// and DenyHeaders are never forwarded, in both directions. Hop-by-hop
+	// headers are never forwarded.
+	AllowHeaders []string
+	DenyHeaders  []string
+
+	// FlushInterval, in milliseconds, flushes streamed responses to the
+	// client periodically. -1 flushes after every write, 0 leaves it to
+	// the buffering of the server.
+	FlushInterval int
+
+	// Timeouts towards the backends, overridden per backend in BackendOptions.
+	Timeouts *TimeoutConfig
+
+	// BackendOptions holds options per backend, keyed by its url as in Backends.
+	BackendOptions map[string]BackendOptions
+
+	// HashKey is what the consistent-hash method hashes; path (default),
+	// header:Name, cookie:Name or ip.
+	HashKey string
+
+	// LatencyDecay, in milliseconds (default 10000), is how fast the
+	// peak-ewma method forgets latency.
+	LatencyDecay int
+
+	// Healthcheck tunes the per-backend healthchecks, enabled by
+	// HealthcheckActive.
+	Healthcheck *HealthcheckConfig
+
+	// Breaker stops requests to failing backends, overridden per backend
+	// in BackendOptions.
+	Breaker *BreakerConfig
+
+	// Outlier ejects backends, failing live requests.
+	Outlier *OutlierConfig
+
+	// SlowStart ramps up the traffic of backends, joining or recovering.
+	SlowStart *SlowStartConfig
+
+	// Sticky pins clients to a backend, with a cookie.
+	Sticky *StickyConfig
+
+	// Retry retries failed requests on another backend.
+	Retry *RetryConfig
+
+	// Pool limits the connections to each backend, overridden per backend
+	// in BackendOptions.
+	Pool *PoolConfig
+
+	// Concurrency limits the requests in flight to each backend, overridden
+	// per backend in BackendOptions.
+	Concurrency *ConcurrencyConfig
+}
+
+// ConcurrencyConfig caps the requests in flight to a backend, at
+// MaxBackendConnections (default unlimited). Requests over the cap wait in
+// a FIFO queue of MaxQueue (default 100), for QueueTimeout milliseconds
+// (default 5000), and are answered 503, with Retry-After, after that.
+type ConcurrencyConfig struct {
+	MaxBackendConnections int
+	MaxQueue              int
+	QueueTimeout          int
+}
+
+// NewConcurrency returns the concurrency of the route, with the fields the
+// backend sets overriding it.
+func NewConcurrency(route *ConcurrencyConfig, backend *ConcurrencyConfig) ConcurrencyConfig {
+	concurrency := ConcurrencyConfig{MaxQueue: 100, QueueTimeout: 5000}
+	for _, config := range []*ConcurrencyConfig{route, backend} {
+		if config == nil {
+			continue
+		}
+		if config.MaxBackendConnections > 0 {
+			concurrency.MaxBackendConnections = config.MaxBackendConnections
+		}
+		if config.MaxQueue > 0 {
+			concurrency.MaxQueue = config.MaxQueue
+		}
+		if config.QueueTimeout > 0 {
+			concurrency.QueueTimeout = config.QueueTimeout
+		}
+	}
+	return concurrency
+}
+
+// PoolConfig describes the connection-pool of a backend. MaxConnections
+// (default unlimited) and MaxIdleConnections (default 32) are per backend,
+// IdleTimeout (default 30000) and KeepAlive (default 30000) in milliseconds.
+type PoolConfig struct {
+	MaxConnections     int
+	MaxIdleConnections int
+	IdleTimeout        int
+	KeepAlive          int
+}
+
+// HealthcheckConfig describes the probes of each backend, sent every
+// HealthcheckInterval seconds, and given Timeout milliseconds (default
+// the interval). A backend is taken out after Fall (default 3) failed
+// probes in a row, and back in after Rise (default 2) successful ones.
+//
+// Type is http (default) or https, sending Method (default GET) with
+// Headers ("Name: value") to HealthcheckPath, expecting Status (200,
+// 200-299 or 2xx; default HealthcheckStatus), and a body containing Body
+// and matching the regular expression BodyMatch. tcp connects only, and
+// grpc calls the standard grpc.health.v1 Health/Check for Service. TLS
+// applies to https and grpc on https-backends.
+type HealthcheckConfig struct {
+	Rise      int
+	Fall      int
+	Timeout   int
+	Type      string
+	Method    string
+	Headers   []string
+	Status    []string
+	Body      string
+	BodyMatch string
+	Service   string
+	TLS       *ProbeTLSConfig
+}
+
+// ProbeTLSConfig holds the TLS settings of probes; ServerName to verify,
+// or skip verification, the CAFile to verify with, and CertFile and
+// KeyFile of a client certificate.
+type ProbeTLSConfig struct {
+	ServerName         string
+	InsecureSkipVerify bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+}
+
+// BreakerConfig describes a CircuitBreaker. It opens after Failures
+// (default 5) failed or 5xx requests in a row, for OpenDuration
+// milliseconds (default 10000), then lets HalfOpenRequests (default 1)
+// trial requests through, closing when they succeed.
+type BreakerConfig struct {
+	Failures         int
+	OpenDuration     int
+	HalfOpenRequests int
+}
+
+// OutlierConfig describes an OutlierDetector. A backend is ejected after
+// ConsecutiveErrors (default 5) 5xx or failed requests in a row, or when
+// ErrorRate (0 to 1, default off) of at least MinRequests (default 20)
+// within Window milliseconds (default 10000) fail. It is ejected for
+// BaseEjection milliseconds (default 30000), doubling on every ejection up
+// to MaxEjection (default 300000). At most MaxEjectedPercent (default 50)
+// of the backends are ejected at a time.
+type OutlierConfig struct {
+	ConsecutiveErrors int
+	ErrorRate         float64
+	MinRequests       int
+	Window            int
+	BaseEjection      int
+	MaxEjection       int
+	MaxEjectedPercent int
+}
+
+// SlowStartConfig describes a SlowStart. Backends joining the route on a
+// reload, recovering from their healthchecks or returning from ejection,
+// start at MinPercent (default 10) of their share of the requests, growing
+// linearly to all of it over Window milliseconds (default 30000).
+type SlowStartConfig struct {
+	Window     int
+	MinPercent int
+}
+
+// StickyConfig describes StickySessions. Cookie (default lb_backend) is
+// set for Path (default /) and Domain, for TTL seconds (default the
+// browser session), with the Secure, HttpOnly and SameSite (lax, strict or
+// none) flags. Secret signs the cookie, and should be shared by instances
+// of the loadbalancer; by default a random secret is used per instance.
+type StickyConfig struct {
+	Cookie   string
+	TTL      int
+	Path     string
+	Domain   string
+	Secure   bool
+	HttpOnly bool
+	SameSite string
+	Secret   string
+}
+
+// RetryConfig describes a RetryPolicy. Attempts counts the first try too
+// (default 2). RetryOn lists connect (refused, dns, tls, connect-timeout,
+// overloaded, circuit open), timeout, 5xx or status codes (default
+// connect, 502 and 503). Only idempotent methods are retried, unless
+// NonIdempotent. Bodies up to MaxBodyBytes (default 64KB) are buffered for
+// replay. Retries are budgeted to BudgetRatio of requests (default 0.2),
+// plus BudgetMinPerSecond (default 10).
+type RetryConfig struct {
+	Attempts           int
+	RetryOn            []string
+	NonIdempotent      bool
+	MaxBodyBytes       int64
+	BudgetRatio        float64
+	BudgetMinPerSecond int
+}
+
+// BackendOptions are the options of a single backend. Weight (default 1)
+// is its share of requests, with the weighted-round-robin and
+// consistent-hash methods; 0 drains it.
+type BackendOptions struct {
+	Weight      *int
+	Timeouts    *TimeoutConfig
+	Pool        *PoolConfig
+	Concurrency *ConcurrencyConfig
+	Breaker     *BreakerConfig
+}
+
+// TimeoutConfig holds timeouts in milliseconds; Connect for dialing,
+// TLSHandshake, ResponseHeader for the time to first byte, and Total for
+// the whole request. Zero means no timeout, or when overriding, inherit.
+type TimeoutConfig struct {
+	Connect        int
+	TLSHandshake   int
+	ResponseHeader int
+	Total          int
+}
+
+// RewriteConfig describes a RewriteTargetRule. StripPrefix is removed from
+// the path, Match is replaced by Replace ($1, and {name} captured by the
+// route), and AddPrefix is added. Host is sent to the backend as the Host,
+// or with PreserveHost, the Host of the client. By default backends
+// receive their own host, and the client's as X-Forwarded-Host.
+type RewriteConfig struct {
+	StripPrefix  string
+	AddPrefix    string
+	Match        string
+	Replace      string
+	Host         string
+	PreserveHost bool
+}
+
+// PredicateConfig describes a RequestPredicate. Type is one of header,
+// query, cookie (Name, and either Value or the regular expression Match,
+// or neither to test presence), method and cidr (Values), time (From and
+// To, as 15:04), or one of and, or and not, combining Predicates.
+type PredicateConfig struct {
+	Type       string
+	Name       string
+	Value      string
+	Match      string
+	Values     []string
+	From       string
+	To         string
+	Predicates []PredicateConfig
+}
+
+// RoutesFromSDK wraps sdk.Routes, using default options.
+func RoutesFromSDK(Routes []sdk.Route) []Route {
+	routes := make([]Route, len(Routes))
+	for i, Route := range Routes {
+		routes[i].Route = Route
+	}
+	return routes
+}
+
+// LoadRoutesFromFile reads a JSON-encoded list of routes, including the
+// loadbalancer options. If the document isn't a plain list of routes, it is
+// left to the sdk to load it.
+func LoadRoutesFromFile(file string) ([]Route, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []Route
+	if err := json.Unmarshal(content, &routes); err == nil {
+		return routes, nil
+	}
+
+	Routes, err := sdk.LoadbalancerConfigurationFromFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return RoutesFromSDK(Routes), nil
+}
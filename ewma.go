@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// failurePenalty is the least latency observed, for a failed request.
+const failurePenalty = time.Second
+
+// peakEWMA is a moving average of latency, that jumps to peaks at once and
+// decays over time, so a degraded backend is avoided immediately, and
+// tried again gradually.
+type peakEWMA struct {
+	sync.Mutex
+	value float64
+	stamp time.Time
+}
+
+// observe adds a latency sample, in nanoseconds.
+func (e *peakEWMA) observe(rtt float64, decay time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	e.update(rtt, decay)
+}
+
+func (e *peakEWMA) update(rtt float64, decay time.Duration) {
+	now := time.Now()
+	if rtt > e.value {
+		e.value = rtt
+	} else if !e.stamp.IsZero() {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(decay))
+		e.value = e.value*w + rtt*(1-w)
+	}
+	e.stamp = now
+}
+
+// get returns the average, decayed for the time without samples.
+func (e *peakEWMA) get(decay time.Duration) float64 {
+	e.Lock()
+	defer e.Unlock()
+	e.update(0, decay)
+	return e.value
+}
+
+// peakEWMAStrategy samples two backends at random, and picks the one with
+// the lower latency, weighted by the requests in flight (power of two
+// choices).
+type peakEWMAStrategy struct {
+	StrategyHooks
+	Decay   time.Duration
+	latency [64]peakEWMA
+}
+
+func newPeakEWMA(Route Route) (Strategy, error) {
+	decay := 10 * time.Second
+	if Route.LatencyDecay > 0 {
+		decay = time.Duration(Route.LatencyDecay) * time.Millisecond
+	}
+	return &peakEWMAStrategy{Decay: decay}, nil
+}
+
+// cost of a backend, the latency weighted by the requests in flight.
+func (p *peakEWMAStrategy) cost(lb *LoadBalancer, backend int) float64 {
+	inflight := float64(atomic.LoadInt64(&lb.InFlight[backend]))
+	return p.latency[backend].get(p.Decay) * (inflight + 1)
+}
+
+// Select samples among the healthy backends only, as the latency of
+// the others decays, while they get no requests.
+func (p *peakEWMAStrategy) Select(lb *LoadBalancer, req *http.Request) int {
+	var healthy [64]int
+	n := 0
+	for i := 0; i < lb.Count; i++ {
+		if lb.Healthy(i) {
+			healthy[n] = i
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return RoundRobinStrategy(lb, req)
+	case 1:
+		return healthy[0]
+	}
+
+	a := rand.Intn(n)
+	b := rand.Intn(n - 1)
+	if b >= a {
+		b++
+	}
+	if p.cost(lb, healthy[b]) < p.cost(lb, healthy[a]) {
+		return healthy[b]
+	}
+	return healthy[a]
+}
+
+// RequestFinished samples the latency. Failures are penalized, so a
+// backend failing fast does not look attractive.
+func (p *peakEWMAStrategy) RequestFinished(lb *LoadBalancer, backend int, req *http.Request, outcome *ProxyOutcome, latency time.Duration) {
+	if latency == 0 {
+		return
+	}
+	if outcome.Reason != "" && latency < failurePenalty {
+		latency = failurePenalty
+	}
+	p.latency[backend].observe(float64(latency), p.Decay)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// virtualNodes per unit of weight, on the hash ring. More nodes spread
+// keys more evenly, at the cost of a larger ring.
+const virtualNodes = 160
+
+// hashRing maps keys to backends, so adding or removing one of N backends
+// only moves about 1/N of the keys.
+type hashRing struct {
+	points   []uint64
+	backends []int
+}
+
+// hashString hashes with FNV-1a, finalized as in murmur3, as FNV alone
+// clusters similar keys (user-1, user-2) on the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// newHashRing places the backends on the ring, by their name, so their
+// place does not depend on their position in the LoadBalancer. Backends
+// are given virtual nodes by weight, and drained ones none.
+func newHashRing(lb *LoadBalancer) *hashRing {
+	type point struct {
+		hash    uint64
+		backend int
+	}
+	var points []point
+	for i := 0; i < lb.Count; i++ {
+		name := lb.backendName(i)
+		nodes := int(atomic.LoadInt64(&lb.Weights[i])) * virtualNodes
+		for v := 0; v < nodes; v++ {
+			points = append(points, point{hashString(fmt.Sprintf("%s#%d", name, v)), i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	ring := &hashRing{points: make([]uint64, len(points)), backends: make([]int, len(points))}
+	for i, p := range points {
+		ring.points[i], ring.backends[i] = p.hash, p.backend
+	}
+	return ring
+}
+
+// Get returns the backend owning the key, the first clockwise of its hash,
+// skipping backends not accepted; only their keys move.
+func (r *hashRing) Get(key string, accept func(backend int) bool) (int, bool) {
+	hash := hashString(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	for n := 0; n < len(r.points); n++ {
+		i := (start + n) % len(r.points)
+		if accept(r.backends[i]) {
+			return r.backends[i], true
+		}
+	}
+	return 0, false
+}
+
+// consistentHash picks the backend owning the HashKey of the request, on
+// the hash ring. The ring is rebuilt, when backends or weights change.
+type consistentHash struct {
+	StrategyHooks
+	sync.Mutex
+	HashKey func(req *http.Request) string
+	ring    *hashRing
+	version int64
+}
+
+func newConsistentHash(Route Route) (Strategy, error) {
+	hashKey, err := NewHashKey(Route.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	return &consistentHash{HashKey: hashKey}, nil
+}
+
+func (c *consistentHash) Select(lb *LoadBalancer, req *http.Request) int {
+	if candidate, ok := c.SelectAccepted(lb, req, lb.Healthy); ok {
+		return candidate
+	}
+
+	// Everything is drained or unhealthy, fall back on the backends as equals.
+	return RoundRobinStrategy(lb, req)
+}
+
+// SelectAccepted follows the ring, past the backends not accepted, so keys
+// move on to the same backend, as when it is taken out.
+func (c *consistentHash) SelectAccepted(lb *LoadBalancer, req *http.Request, accept func(backend int) bool) (int, bool) {
+	if req == nil {
+		return 0, false
+	}
+
+	c.Lock()
+	if version := atomic.LoadInt64(&lb.reweighed); c.ring == nil || c.version != version {
+		c.ring, c.version = newHashRing(lb), version
+	}
+	ring := c.ring
+	c.Unlock()
+
+	return ring.Get(c.HashKey(req), accept)
+}
+
+func (c *consistentHash) BackendAdded(lb *LoadBalancer, backend int) {
+	c.Lock()
+	defer c.Unlock()
+	c.ring = nil
+}
+
+// NewHashKey returns the function extracting the hash key of a request;
+// one of path (default), header:Name, cookie:Name or ip. Requests
+// without the header or cookie are hashed by their client ip.
+func NewHashKey(spec string) (func(req *http.Request) string, error) {
+	kind, name := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, name = spec[:i], spec[i+1:]
+	}
+
+	switch strings.ToLower(kind) {
+	case "", "path":
+		return func(req *http.Request) string {
+			return req.URL.Path
+		}, nil
+	case "ip":
+		return clientIP, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("Hash key %s needs a header name", spec)
+		}
+		return func(req *http.Request) string {
+			if value := req.Header.Get(name); value != "" {
+				return value
+			}
+			return clientIP(req)
+		}, nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("Hash key %s needs a cookie name", spec)
+		}
+		return func(req *http.Request) string {
+			if cookie, err := req.Cookie(name); err == nil && cookie.Value != "" {
+				return cookie.Value
+			}
+			return clientIP(req)
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown hash key %s", spec)
+}
+
+func clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sdk "github.com/newsworthy39/golang-clouddom-sdk"
+)
+
+// HealthChecker probes a single backend of a LoadBalancer, marking it
+// unhealthy after Fall failed probes in a row, and healthy again after
+// Rise successful ones. Every transition is sent as an event.
+type HealthChecker struct {
+	Probe     Probe
+	Interval  time.Duration
+	Timeout   time.Duration
+	Rise      int
+	Fall      int
+	lb        *LoadBalancer
+	backend   int
+	route     string
+	apiConfig *sdk.APIContext
+	successes int
+	failures  int
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewHealthChecker builds the checker of a backend, from the healthcheck
+// of the route.
+func NewHealthChecker(apiConfig *sdk.APIContext, Route Route, lb *LoadBalancer, backend int) (*HealthChecker, error) {
+	probe, err := NewProbe(Route, lb.Backends[backend])
+	if err != nil {
+		return nil, err
+	}
+
+	checker := &HealthChecker{Probe: probe,
+		Interval:  time.Duration(Route.HealthcheckInterval) * time.Second,
+		Rise:      2,
+		Fall:      3,
+		lb:        lb,
+		backend:   backend,
+		apiConfig: apiConfig,
+		stop:      make(chan struct{})}
+
+	if checker.Interval <= 0 {
+		checker.Interval = 10 * time.Second
+	}
+	if config := Route.Healthcheck; config != nil {
+		if config.Rise > 0 {
+			checker.Rise = config.Rise
+		}
+		if config.Fall > 0 {
+			checker.Fall = config.Fall
+		}
+		checker.Timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+
+	// Probes should not outlive their interval.
+	if checker.Timeout <= 0 || checker.Timeout > checker.Interval {
+		checker.Timeout = checker.Interval
+	}
+	return checker, nil
+}
+
+// Start probes the backend, every Interval, until stopped.
+func (h *HealthChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+
+		h.Check()
+		for {
+			select {
+			case <-ticker.C:
+				h.Check()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *HealthChecker) String() string {
+	return fmt.Sprintf("healthcheck of %s", h.lb.Backends[h.backend])
+}
+
+// Stop ends the probes.
+func (h *HealthChecker) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+}
+
+// Check probes the backend once, and updates its state.
+func (h *HealthChecker) Check() {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	err := h.Probe.Probe(ctx)
+	cancel()
+
+	if err == nil {
+		h.successes++
+		h.failures = 0
+	} else {
+		h.failures++
+		h.successes = 0
+	}
+
+	healthy := h.lb.Probed(h.backend)
+	switch {
+	case healthy && h.failures >= h.Fall:
+		h.lb.SetHealthy(h.backend, false)
+		log.Printf("Backend %s is unhealthy, after %d failed probes, err: %s\n", h.lb.Backends[h.backend], h.failures, err)
+		sendEvent(h.apiConfig, 1000, fmt.Sprintf("HealthcheckFailed %s: %s", h.lb.Backends[h.backend], err))
+	case !healthy && h.successes >= h.Rise:
+		h.lb.SetHealthy(h.backend, true)
+		log.Printf("Backend %s is healthy, after %d probes\n", h.lb.Backends[h.backend], h.successes)
+		sendEvent(h.apiConfig, 1001, fmt.Sprintf("HealthcheckRecovered %s", h.lb.Backends[h.backend]))
+	}
+}
+
+// newHealthChecks returns a checker per backend of the LoadBalancer, when
+// the route has its healthcheck active. They are started, once the whole
+// configuration loaded, and stopped along with the timers, on the next.
+func newHealthChecks(apiConfig *sdk.APIContext, Route Route, lb *LoadBalancer) ([]*HealthChecker, error) {
+	if Route.HealthcheckActive != 1 {
+		return nil, nil
+	}
+	var checkers []*HealthChecker
+	for i := 0; i < lb.Count; i++ {
+		checker, err := NewHealthChecker(apiConfig, Route, lb, i)
+		if err != nil {
+			return nil, fmt.Errorf("Route %s: healthcheck of %s: %s", Route.Path, lb.Backends[i], err)
+		}
+		checker.route = routeKey(Route)
+		checkers = append(checkers, checker)
+	}
+	return checkers, nil
+}
+
+// inherit marks the backend down, when it is down in the balancers of its
+// route, the configuration replaces; so it takes no traffic, until its
+// probes find it up again.
+func (h *HealthChecker) inherit() {
+	balancers.Lock()
+	defer balancers.Unlock()
+
+	for _, lb := range balancers.m[h.route] {
+		for i := 0; i < lb.Count; i++ {
+			if lb.Backends[i] == h.lb.Backends[h.backend] && !lb.Probed(i) {
+				atomic.StoreInt32(&h.lb.down[h.backend], 1)
+			}
+		}
+	}
+}
+
+// SetHealthy marks a backend healthy or not, by its probes. Recovering
+// backends start slowly.
+func (l *LoadBalancer) SetHealthy(backend int, healthy bool) {
+	var down int32
+	if !healthy {
+		down = 1
+	}
+	if atomic.SwapInt32(&l.down[backend], down) == 1 && healthy {
+		l.startSlowly(backend)
+	}
+}
+
+// Probed reports if a backend is healthy by its probes.
+func (l *LoadBalancer) Probed(backend int) bool {
+	return atomic.LoadInt32(&l.down[backend]) == 0
+}
+
+// Healthy reports if a backend is healthy, by its probes, and not ejected
+// for its errors. Backends start out healthy.
+func (l *LoadBalancer) Healthy(backend int) bool {
+	return atomic.LoadInt32(&l.down[backend]) == 0 && atomic.LoadInt32(&l.ejected[backend]) == 0
+}
+
+// nextHealthy returns the first healthy backend after candidate, or the
+// candidate itself, when no backend is healthy.
+func (l *LoadBalancer) nextHealthy(candidate int) int {
+	for i := 1; i < l.Count; i++ {
+		next := (candidate + i) % l.Count
+		if l.Healthy(next) {
+			return next
+		}
+	}
+	return candidate
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("backend queue full")
+	ErrQueueTimeout = errors.New("backend queue timeout")
+)
+
+// reasonOverloaded is recorded for a request, that got no slot with the
+// backend.
+const reasonOverloaded = "overloaded"
+
+// connectionLimiter caps the requests in flight to a backend. Requests
+// over the limit wait in a bounded FIFO queue, for at most the timeout.
+type connectionLimiter struct {
+	sync.Mutex
+	limit    int
+	maxQueue int
+	timeout  time.Duration
+	active   int
+	queue    *list.List
+}
+
+// limiters are shared by backend and settings, so the limit holds across
+// routes, and across a reload.
+var limiters = newRegistry[*connectionLimiter](nil)
+
+func newConnectionLimiter(limit int, maxQueue int, timeout time.Duration) *connectionLimiter {
+	return &connectionLimiter{limit: limit, maxQueue: maxQueue, timeout: timeout, queue: list.New()}
+}
+
+// limiterFor returns the limiter of the backend, creating it on first use.
+func limiterFor(backend string, limit int, maxQueue int, timeout time.Duration) *connectionLimiter {
+	key := fmt.Sprintf("%s %d %d %s", backend, limit, maxQueue, timeout)
+	return limiters.get(key, func() *connectionLimiter {
+		return newConnectionLimiter(limit, maxQueue, timeout)
+	})
+}
+
+// Acquire takes a slot, waiting in the queue if needed. Every successful
+// Acquire must be paired with a Release.
+func (l *connectionLimiter) Acquire(ctx context.Context) error {
+	l.Lock()
+	if l.active < l.limit && l.queue.Len() == 0 {
+		l.active++
+		l.Unlock()
+		return nil
+	}
+	if l.queue.Len() >= l.maxQueue {
+		l.Unlock()
+		return ErrQueueFull
+	}
+
+	ready := make(chan struct{})
+	waiter := l.queue.PushBack(ready)
+	l.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	select {
+	case <-ready:
+		// The slot was handed over, while we gave up. Pass it on.
+		l.release()
+	default:
+		l.queue.Remove(waiter)
+	}
+	return err
+}
+
+// Release returns a slot, handing it to the first waiter, if any.
+func (l *connectionLimiter) Release() {
+	l.Lock()
+	defer l.Unlock()
+	l.release()
+}
+
+func (l *connectionLimiter) release() {
+	if front := l.queue.Front(); front != nil {
+		l.queue.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	l.active--
+}
+
+// Stats returns the requests in flight, and waiting.
+func (l *connectionLimiter) Stats() (int, int) {
+	l.Lock()
+	defer l.Unlock()
+	return l.active, l.queue.Len()
+}
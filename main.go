@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"io"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	//	zmq "github.com/pebbe/zmq4"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/httptest"
-	//	"regexp"
+	"reflect"
+	"regexp"
 	"flag"
 	"github.com/BenLubar/memoize"
 	"github.com/newsworthy39/golang-https-loadbalancer/util"
@@ -23,7 +27,7 @@ import (
 )
 
 // Create root-node in graph, and monkey-patch our configuration onto it.
-var routeexpressions = new(util.List)
+var routeexpressions = NewRouteTable()
 var timers = new(util.List)
 
 // This is used to output statuscode
@@ -82,6 +86,9 @@ type bufferedResponseWriter struct {
 	http.ResponseWriter // embed struct
 	HTTPStatus          int
 	ResponseSize        int
+	Hijacked            bool
+	BytesIn             int64 // read from a hijacked connection
+	BytesOut            int64 // written to a hijacked connection
 }
 
 func (w *bufferedResponseWriter) WriteHeader(status int) {
@@ -90,11 +97,42 @@ func (w *bufferedResponseWriter) WriteHeader(status int) {
 }
 
 func (w *bufferedResponseWriter) Flush() {
+	if w.Hijacked {
+		return
+	}
 	z := w.ResponseWriter
 	if f, ok := z.(http.Flusher); ok {
 		f.Flush()
 	}
 }
+
+// Hijack counts the bytes read from, and written to the connection, so
+// tunnels can be logged.
+func (w *bufferedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack: ResponseWriter does not support hijacking")
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.Hijacked = true
+	if w.HTTPStatus == 0 {
+		w.HTTPStatus = http.StatusSwitchingProtocols
+	}
+
+	counting := &countingConn{Conn: conn, read: &w.BytesIn, written: &w.BytesOut}
+	var reader io.Reader = counting
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		atomic.AddInt64(&w.BytesIn, int64(n))
+		reader = io.MultiReader(bytes.NewReader(buffered), counting)
+	}
+	return counting, bufio.NewReadWriter(bufio.NewReader(reader), bufio.NewWriter(counting)), nil
+}
 func (w *bufferedResponseWriter) CloseNotify() <-chan bool {
 	z := w.ResponseWriter
 	return z.(http.CloseNotifier).CloseNotify()
@@ -111,74 +149,192 @@ func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
 
 type ProxyTargetRule struct {
 	Target                   string
-	transport                [64]*http.Transport
+	StripPrefix              bool
+	AllowHeaders             []string
+	DenyHeaders              []string
+	FlushInterval            time.Duration
+	Timeouts                 Timeouts
+	active                   int64
+	apiConfig                *sdk.APIContext
+	target                   *url.URL
 	MaxBackendConnections    int
-	activeBackendConnections int
+	MaxQueue                 int
+	QueueTimeout             time.Duration
+	limiter                  *connectionLimiter
+	Breaker                  BreakerSettings
+	breaker                  *CircuitBreaker
+	Pool                     PoolLimits
+	pool                     *backendPool
+	poolOnce                 sync.Once
 	Next                     *http.Handler
 }
 
 func NewProxyTargetRule(Destination sdk.Backend, MaxBackends int) *ProxyTargetRule {
+	// Destination.Backend = http://something:port/maybethis
+	target, err := url.Parse(Destination.Backend)
+	if err != nil {
+		fmt.Printf("Error parsing Target in ProxyTargetRule, %s, err: %s", Destination.Backend, err)
+	}
+
+	// MaxBackends caps the requests in flight, when positive. The rest
+	// wait in a queue, of MaxQueue requests for QueueTimeout at most.
 	return &ProxyTargetRule{Target: Destination.Backend,
-		MaxBackendConnections: MaxBackends}
+		target: target,
+		MaxBackendConnections: MaxBackends,
+		MaxQueue: 100,
+		QueueTimeout: 5 * time.Second,
+		Pool: NewPoolLimits(nil, nil)}
 }
 
 func (p *ProxyTargetRule) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	if p.transport[p.activeBackendConnections] == nil {
-		p.transport[p.activeBackendConnections] = &http.Transport{
-			MaxIdleConns:       10,
-			IdleConnTimeout:    30 * time.Second,
-			DisableCompression: false}
+	p.poolOnce.Do(p.share)
+
+	// Tunnels count, for as long as they are open.
+	atomic.AddInt64(&p.active, 1)
+	atomic.AddInt64(&p.pool.active, 1)
+	defer atomic.AddInt64(&p.active, -1)
+	defer atomic.AddInt64(&p.pool.active, -1)
+
+	if p.target == nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		status := HTTPStatusCode{http.StatusInternalServerError,
+				fmt.Sprintf("Invalid backend, %s", p.Target)}
+		tmpl.Execute(res, status)
+		return
 	}
 
-	// Setup client, to *not* follow redirects, thanks to this hack.
-	client := &http.Client{
-		Transport: p.transport[p.activeBackendConnections],
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	// While the breaker is open, fail fast, rather than wait on timeouts.
+	// The result is reported, once the response headers arrive, so streams
+	// and tunnels do not hold a half-open trial while they last; returning
+	// before that, it is reported on the way out.
+	result := breakerIgnored
+	report := func() {}
+	if p.breaker != nil {
+		ticket, allowed, wait := p.breaker.Allow()
+		if !allowed {
+			p.unavailable(res, req, reasonCircuitOpen, wait)
+			return
+		}
+		reported := false
+		report = func() {
+			if !reported {
+				reported = true
+				p.breaker.Done(ticket, result)
+			}
+		}
+		defer report()
 	}
 
-	// p.Target = http://something:port/maybethis
-	org, er := url.Parse(p.Target)
-	if er != nil {
-		fmt.Printf("Error parsing Target in ProxyTargetRule, %s, err: %s", p.Target, er)
+	if p.limiter != nil {
+		if err := p.limiter.Acquire(req.Context()); err != nil {
+			if req.Context().Err() == context.Canceled {
+				log.Printf("Client went away, queued for %s\n", p.Target)
+				return
+			}
+			log.Printf("Backend %s overloaded, err: %s\n", p.Target, err)
+			p.unavailable(res, req, reasonOverloaded, p.QueueTimeout)
+			return
+		}
+		defer p.limiter.Release()
 	}
 
-	breq, err := http.NewRequest(req.Method, fmt.Sprintf("%s://%s%s", org.Scheme, org.Host, req.URL.Path),
-			req.Body)
+	body := req.Body
+	if req.ContentLength == 0 {
+		body = nil
+	}
 
-	breq.Header.Set("X-Forwarded-Host", req.Host)
-	breq.Header.Set("X-Forwarded-For", fmt.Sprintf("%s, %s", req.Header.Get("X-Forwarded-For"), req.RemoteAddr))
-	breq.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
-	breq.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+	breq, err := http.NewRequest(req.Method, backendURL(p.target, req, p.StripPrefix).String(),
+			body)
+	if err != nil {
+		p.backendFailed(res, req, http.StatusBadGateway, reasonInvalidRequest, err)
+		return
+	}
+	upgrade := upgradeType(req.Header)
+
+	// The total deadline covers the whole exchange, except tunnels.
+	ctx := req.Context()
+	if p.Timeouts.Total > 0 && upgrade == "" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeouts.Total)
+		defer cancel()
+	}
+	breq = breq.WithContext(ctx)
+	breq.ContentLength = req.ContentLength
 
-	if  element := req.Header.Get("AccessKey"); element != "" {
-		breq.Header.Set("AccessKey", element)
+	if host, ok := rewrittenHost(req); ok {
+		breq.Host = host
 	}
 
-	if  secret := req.Header.Get("Secret"); secret != "" {
-		breq.Header.Set("Secret", secret)
+	// Forward end-to-end headers only (RFC 7230, 6.1), but keep upgrades.
+	copyHeader(breq.Header, req.Header)
+	removeHopHeaders(breq.Header)
+	filterHeaders(breq.Header, p.AllowHeaders, p.DenyHeaders)
+
+	if upgrade != "" {
+		breq.Header.Set("Connection", "Upgrade")
+		breq.Header.Set("Upgrade", upgrade)
 	}
 
+	if _, prs := breq.Header["User-Agent"]; !prs {
+		// Without one from the client, keep Go from sending its default User-Agent.
+		breq.Header.Set("User-Agent", "")
+	}
 
-	resp, err := client.Do(breq)
+	breq.Header.Set("X-Forwarded-Host", req.Host)
+	breq.Header.Set("X-Forwarded-For", forwardedFor(req))
+	breq.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
+
+	// Let the backend know, when to stop working.
+	if deadline, ok := ctx.Deadline(); ok {
+		breq.Header.Set("X-Request-Deadline", fmt.Sprintf("%d", deadline.UnixNano()/int64(time.Millisecond)))
+		breq.Header.Set("X-Request-Timeout-Ms", fmt.Sprintf("%d", time.Until(deadline)/time.Millisecond))
+	}
+
+	resp, err := p.pool.Do(breq)
 	if err != nil {
-		// handle error
+		status, reason := classifyBackendError(err)
+		if isTimeout(reason) && ctx.Err() == context.DeadlineExceeded && req.Context().Err() == nil {
+			reason = reasonTimeoutTotal
+		}
+		if req.Context().Err() == nil {
+			result = breakerFailure
+		}
+		p.backendFailed(res, req, status, reason, err)
+		return
 	}
 	defer resp.Body.Close()
 
+	result = breakerSuccess
+	if resp.StatusCode >= 500 {
+		result = breakerFailure
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if switched := upgradeType(resp.Header); upgrade == "" || !strings.EqualFold(switched, upgrade) {
+			result = breakerFailure
+			p.backendFailed(res, req, http.StatusBadGateway, reasonProtocolSwitch,
+				fmt.Errorf("switched protocol to %q, when %q was requested", switched, upgrade))
+			return
+		}
+
+		report()
+		if err := tunnelUpgrade(res, upgrade, resp); err != nil {
+			log.Printf("Error tunnelling %s to %s, err: %s\n", upgrade, p.Target, err)
+		}
+		return
+	}
+
+	report()
+	recordOutcome(req, resp.StatusCode, "")
+	removeHopHeaders(resp.Header)
+	filterHeaders(resp.Header, p.AllowHeaders, p.DenyHeaders)
 	for name, values := range resp.Header {
 		res.Header()[name] = values
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
 	res.WriteHeader(resp.StatusCode)
-	res.Write([]byte(body))
-
-	// Increase and rotate mod MaxBackendConnections.
-	p.activeBackendConnections++
-	if p.activeBackendConnections%p.MaxBackendConnections == 0 {
-		p.activeBackendConnections = 0
+	if _, err := copyResponse(res, resp.Body, p.flushInterval(resp)); err != nil {
+		log.Printf("Error copying response from %s, err: %s\n", p.Target, err)
 	}
 
 	if p.Next != nil {
@@ -190,6 +346,84 @@ func (t *ProxyTargetRule) AddTargetRule(rule http.Handler) {
 	t.Next = &rule
 }
 
+// share looks up the pool, limiter and breaker, shared by every rule using the same
+// backend and settings. Rules of a configuration do so as it is loaded, so
+// the registries know what it uses, others on their first request.
+func (p *ProxyTargetRule) share() {
+	p.pool = poolFor(p.Target, p.Timeouts, p.Pool)
+	if p.MaxBackendConnections > 0 {
+		p.limiter = limiterFor(p.Target, p.MaxBackendConnections, p.MaxQueue, p.QueueTimeout)
+	}
+	if p.Breaker.Failures > 0 {
+		p.breaker = breakerFor(p.apiConfig, p.Target, p.Breaker)
+	}
+}
+
+// backendFailed logs the failure, sends it as an event and renders the
+// status to the client, unless the client went away.
+func (p *ProxyTargetRule) backendFailed(res http.ResponseWriter, req *http.Request, statusCode int, reason string, err error) {
+	if req.Context().Err() == context.Canceled {
+		log.Printf("Client went away, during %s %s to %s\n", req.Method, req.URL.Path, p.Target)
+		return
+	}
+
+	log.Printf("Backend %s failed, %d %s, err: %s\n", p.Target, statusCode, reason, err)
+	recordOutcome(req, statusCode, reason)
+	sendEvent(p.apiConfig, statusCode, fmt.Sprintf("BackendFailed %s: %s", p.Target, reason))
+
+	res.WriteHeader(statusCode)
+	status := HTTPStatusCode{statusCode, fmt.Sprintf("Backend failed, %s", reason)}
+	tmpl.Execute(res, status)
+}
+
+// unavailable renders 503, when the request was not sent to the backend,
+// as it is overloaded, or its circuit is open. It is not sent as an event,
+// as this comes in bursts.
+func (p *ProxyTargetRule) unavailable(res http.ResponseWriter, req *http.Request, reason string, retry time.Duration) {
+	recordOutcome(req, http.StatusServiceUnavailable, reason)
+
+	retryAfter := int64((retry + time.Second - 1) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	res.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+	res.WriteHeader(http.StatusServiceUnavailable)
+	status := HTTPStatusCode{http.StatusServiceUnavailable, fmt.Sprintf("Backend unavailable, %s", reason)}
+	tmpl.Execute(res, status)
+}
+
+// ActiveConnections returns the requests and tunnels in flight.
+func (p *ProxyTargetRule) ActiveConnections() int64 {
+	return atomic.LoadInt64(&p.active)
+}
+
+// flushInterval returns how often to flush the response to the client.
+// Server-sent events are flushed immediately, regardless.
+func (p *ProxyTargetRule) flushInterval(resp *http.Response) time.Duration {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return -1
+	}
+	return p.FlushInterval
+}
+
+// newProxyTargetRuleFromRoute applies the options of the route, to the proxy.
+func newProxyTargetRuleFromRoute(apiConfig *sdk.APIContext, Route Route, backend sdk.Backend) *ProxyTargetRule {
+	concurrency := NewConcurrency(Route.Concurrency, Route.BackendOptions[backend.Backend].Concurrency)
+	proxy := NewProxyTargetRule(backend, concurrency.MaxBackendConnections)
+	proxy.MaxQueue = concurrency.MaxQueue
+	proxy.QueueTimeout = time.Duration(concurrency.QueueTimeout) * time.Millisecond
+	proxy.apiConfig = apiConfig
+	proxy.StripPrefix = Route.StripPrefix
+	proxy.AllowHeaders = Route.AllowHeaders
+	proxy.DenyHeaders = Route.DenyHeaders
+	proxy.FlushInterval = time.Duration(Route.FlushInterval) * time.Millisecond
+	proxy.Timeouts = NewTimeouts(Route.Timeouts, Route.BackendOptions[backend.Backend].Timeouts)
+	proxy.Pool = NewPoolLimits(Route.Pool, Route.BackendOptions[backend.Backend].Pool)
+	proxy.Breaker = NewBreakerSettings(Route.Breaker, Route.BackendOptions[backend.Backend].Breaker)
+	proxy.poolOnce.Do(proxy.share)
+	return proxy
+}
+
 type ContentTargetRule struct {
 	Content    string
 	header     http.Header
@@ -233,7 +467,11 @@ func (p *ContentTargetRule) ServeHTTP(res http.ResponseWriter, req *http.Request
 
 	// Copy headers (http.headers support) - Migrate, to this.
 	for k, v := range p.Header() {
-		res.Header()[k] = v
+		values := make([]string, len(v))
+		for i, value := range v {
+			values[i] = ExpandRouteParams(value, req)
+		}
+		res.Header()[k] = values
 	}
 
 	res.WriteHeader(p.StatusCode)
@@ -244,10 +482,52 @@ func (t *ContentTargetRule) AddTargetRule(rule http.Handler) {
 	t.Next = &rule
 }
 
-// PropositionTargets allow branching.
+// PropositionTargets allow branching. Requests satisfying the Predicate
+// are sent Left, everything else Right.
 type PropositionTargetRule struct {
-	Left  *http.Handler
-	Right *http.Handler
+	Predicate RequestPredicate
+	Left      *http.Handler
+	Right     *http.Handler
+}
+
+func NewPropositionTargetRule(Predicate RequestPredicate, Left http.Handler, Right http.Handler) *PropositionTargetRule {
+	return &PropositionTargetRule{Predicate: Predicate, Left: handlerRef(Left), Right: handlerRef(Right)}
+}
+
+// handlerRef refers to the handler, or is nil when the handler is nil,
+// also when it is a nil pointer wrapped in the interface.
+func handlerRef(h http.Handler) *http.Handler {
+	if h == nil {
+		return nil
+	}
+	if v := reflect.ValueOf(h); v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil
+	}
+	return &h
+}
+
+func (p *PropositionTargetRule) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	next := p.Right
+	if p.Predicate != nil && p.Predicate(req) {
+		next = p.Left
+	}
+
+	if next == nil || *next == nil {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		status := HTTPStatusCode{http.StatusServiceUnavailable, "No target"}
+		tmpl.Execute(res, status)
+		return
+	}
+	(*next).ServeHTTP(res, req)
+}
+
+// AddTargetRule adds Left first, then Right.
+func (p *PropositionTargetRule) AddTargetRule(rule http.Handler) {
+	if p.Left == nil {
+		p.Left = &rule
+	} else {
+		p.Right = &rule
+	}
 }
 
 type CacheTargetRule struct {
@@ -272,7 +552,7 @@ func (c *CacheTargetRule) ServeHTTP(res http.ResponseWriter, req *http.Request)
 	if c.IsNew {
 		c.RUnlock()
 		c.Lock()
-		interceptWriter := &bufferedResponseWriter{res, 0, 0}
+		interceptWriter := &bufferedResponseWriter{ResponseWriter: res}
 		defer interceptWriter.Flush()
 		(*c.Next).ServeHTTP(interceptWriter, req)
 
@@ -294,31 +574,204 @@ func (t *CacheTargetRule) AddTargetRule(rule http.Handler) {
 	t.Next = &rule
 }
 
+// RouteExpression matches a path. Paths are literal prefixes, templates
+// as /users/{id}/orders, or regular expressions prefixed by ~, as
+// ~^/v[0-9]+/. Captured values are available through RouteParams.
 type RouteExpression struct {
 	Path        string
+	Hosts       []string
 	Next        *http.Handler
+	prefix      string
+	pattern     *regexp.Regexp
+	bounded     bool
+}
+
+// RouteMatch holds the outcome of matching a request, to a RouteExpression.
+type RouteMatch struct {
+	Route  *RouteExpression
+	Prefix string
+	Params map[string]string
 }
 
+type routeMatchKey struct{}
+
+var templateParameter = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?::([^{}]+))?\}`)
+
 func NewRouteExpression(Path string) *RouteExpression {
 	Route := new(RouteExpression)
 	Route.Path = Path
 	return Route
 }
 
+// NewHostRouteExpression matches Path, on the Hosts given. Hosts can be
+// exact, wildcard subdomains (*.example.com) or the catch-all (*).
+func NewHostRouteExpression(Hosts []string, Path string) *RouteExpression {
+	Route := NewRouteExpression(Path)
+	Route.Hosts = Hosts
+	return Route
+}
+
+// addRouteTargetRule adds the target to the route, after the rewrite of
+// the route, if any.
+func addRouteTargetRule(rootRoute *RouteExpression, Route Route, target http.Handler) error {
+	if Route.Rewrite == nil {
+		rootRoute.AddTargetRule(target)
+		return nil
+	}
+
+	rewrite, err := NewRewriteTargetRule(*Route.Rewrite)
+	if err != nil {
+		return fmt.Errorf("Route %s: %s", Route.Path, err)
+	}
+	rewrite.AddTargetRule(target)
+	rootRoute.AddTargetRule(rewrite)
+	return nil
+}
+
+// newRouteExpressionFromRoute uses Hosts, when the route declares them.
+func newRouteExpressionFromRoute(Route Route) *RouteExpression {
+	if len(Route.Hosts) > 0 {
+		return NewHostRouteExpression(Route.Hosts, Route.Path)
+	}
+	return NewRouteExpression(Route.Path)
+}
+
+// Compile prepares the path of the route for matching. It must be called
+// before Match, and is called by RouteTable.Insert.
+func (r *RouteExpression) Compile() error {
+	path := r.Path
+	if len(r.Hosts) == 0 {
+		if _, _, p, ok := splitRoutePath(r.Path); ok {
+			path = p
+		} else {
+			path = ""
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(path, "~"):
+		pattern, err := regexp.Compile(path[1:])
+		if err != nil {
+			return fmt.Errorf("RouteExpression %s: %s", r.Path, err)
+		}
+		r.pattern = pattern
+		r.prefix = ""
+		r.bounded = false
+		if strings.HasPrefix(path[1:], "^") {
+			r.prefix, _ = pattern.LiteralPrefix()
+		}
+	case templateParameter.MatchString(path):
+		expression := "^"
+		last := 0
+		for _, loc := range templateParameter.FindAllStringSubmatchIndex(path, -1) {
+			expression += regexp.QuoteMeta(path[last:loc[0]])
+			match := "[^/]+"
+			if loc[4] >= 0 {
+				match = path[loc[4]:loc[5]]
+			}
+			expression += fmt.Sprintf("(?P<%s>%s)", path[loc[2]:loc[3]], match)
+			last = loc[1]
+		}
+		expression += regexp.QuoteMeta(path[last:])
+
+		// Templates end on a path segment, as literal prefixes do, so
+		// /users/{id}/orders does not match /users/42/ordersarchive.
+		r.bounded = !strings.HasSuffix(path, "/")
+		if r.bounded {
+			expression += "(?:$|/)"
+		}
+
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return fmt.Errorf("RouteExpression %s: %s", r.Path, err)
+		}
+		r.pattern = pattern
+		r.prefix = path[:templateParameter.FindStringIndex(path)[0]]
+	default:
+		r.pattern = nil
+		r.prefix = path
+		r.bounded = false
+	}
+	return nil
+}
+
+// Match matches the path, returning the matched prefix and captures.
+// Captures are named by their group-name, and by their number.
+func (r *RouteExpression) Match(path string) (*RouteMatch, bool) {
+	if r.pattern == nil {
+		if !strings.HasPrefix(path, r.prefix) {
+			return nil, false
+		}
+		return &RouteMatch{Route: r, Prefix: r.prefix}, true
+	}
+
+	loc := r.pattern.FindStringSubmatchIndex(path)
+	if loc == nil {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, name := range r.pattern.SubexpNames() {
+		if i == 0 || loc[2*i] < 0 {
+			continue
+		}
+		params[fmt.Sprintf("%d", i)] = path[loc[2*i]:loc[2*i+1]]
+		if name != "" {
+			params[name] = path[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	end := loc[1]
+	if r.bounded && end < len(path) {
+		// Leave the / ending the segment, out of the prefix.
+		end--
+	}
+	return &RouteMatch{Route: r, Prefix: path[:end], Params: params}, true
+}
+
 func (r *RouteExpression) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if match, ok := r.Match(req.URL.Path); ok {
+		req = req.WithContext(context.WithValue(req.Context(), routeMatchKey{}, match))
+	}
 	(*r.Next).ServeHTTP(res, req)
 }
 
+// RouteMatchFromRequest returns the match, of the route serving the request.
+func RouteMatchFromRequest(req *http.Request) (*RouteMatch, bool) {
+	match, ok := req.Context().Value(routeMatchKey{}).(*RouteMatch)
+	return match, ok
+}
+
+// RouteParams returns the values captured by the route, serving the request.
+func RouteParams(req *http.Request) map[string]string {
+	if match, ok := RouteMatchFromRequest(req); ok {
+		return match.Params
+	}
+	return nil
+}
+
+// ExpandRouteParams replaces {name} and {1} in s, with the values captured
+// by the route serving the request.
+func ExpandRouteParams(s string, req *http.Request) string {
+	params := RouteParams(req)
+	if len(params) == 0 || !strings.Contains(s, "{") {
+		return s
+	}
+	for name, value := range params {
+		s = strings.Replace(s, "{"+name+"}", value, -1)
+	}
+	return s
+}
+
 func (r *RouteExpression) AddTargetRule(rule http.Handler) {
 	r.Next = &rule
 }
 
-func RandomStrategy(lb *LoadBalancer) int {
+func RandomStrategy(lb *LoadBalancer, req *http.Request) int {
         return rand.Intn(lb.Count)
 }
 
-func RoundRobinStrategy(lb *LoadBalancer) int {
-        r := lb.Requests
+func RoundRobinStrategy(lb *LoadBalancer, req *http.Request) int {
+        r := atomic.LoadInt64(&lb.Requests)
 	if (lb.Count > 0) {
 	        return int(r) % lb.Count
 	} else {
@@ -326,41 +779,138 @@ func RoundRobinStrategy(lb *LoadBalancer) int {
 	}
 }
 
-func SelectStrategy(lb *LoadBalancer) int {
-        m := map[string]func(lb *LoadBalancer) int {
-                "round-robin": RoundRobinStrategy,
-                "random": RandomStrategy,
-        }
-	_, prs := m[lb.Method]
-	if prs == false {
-	        return m["round-robin"](lb)
-	} else {
-		return m[lb.Method](lb)
+// LeastConnectionsStrategy picks the healthy backend with the fewest
+// requests in flight, breaking ties randomly.
+func LeastConnectionsStrategy(lb *LoadBalancer, req *http.Request) int {
+	candidate, ties := 0, 0
+	least := int64(-1)
+	for i := 0; i < lb.Count; i++ {
+		if !lb.Healthy(i) {
+			continue
+		}
+		inflight := atomic.LoadInt64(&lb.InFlight[i])
+		switch {
+		case least < 0 || inflight < least:
+			candidate, least, ties = i, inflight, 1
+		case inflight == least:
+			// Reservoir-sampling, so every tie is equally likely.
+			ties++
+			if rand.Intn(ties) == 0 {
+				candidate = i
+			}
+		}
 	}
+	return candidate
+}
+
+// SelectStrategy selects the backend of the request, the pinned one with
+// sticky sessions, otherwise by the Strategy of the LoadBalancer. Should
+// the Strategy pick an unhealthy backend, the next healthy one is used,
+// and a backend starting slowly passes some of its requests on.
+func SelectStrategy(lb *LoadBalancer, req *http.Request) int {
+	if lb.Sticky != nil && req != nil {
+		if candidate, ok := lb.Sticky.Backend(lb, req); ok {
+			return candidate
+		}
+	}
+	candidate := lb.Strategy.Select(lb, req)
+	if !lb.Healthy(candidate) {
+		candidate = lb.nextHealthy(candidate)
+	}
+	if !lb.admits(candidate) {
+		candidate = lb.reselect(req, candidate)
+	}
+	return candidate
 }
 
 
 type LoadBalancer struct {
-	Requests     int
+	Requests     int64
 	Next         [64]*http.Handler
+	InFlight     [64]int64
+	Backends     [64]string
+	Weights      [64]int64
+	reweighed    int64
+	Sticky       *StickySessions
+	down         [64]int32
+	ejected      [64]int32
+	Outlier      *OutlierDetector
+	SlowStart    *SlowStart
+	warming      [64]int64
 	Count	     int
 	Method       string
+	Strategy     Strategy
+	Retry        *RetryPolicy
 }
 
-func NewLoadBalancer(method string) *LoadBalancer {
-	return &LoadBalancer { Count: 0, Requests: 0, Method: method}
+// NewLoadBalancer returns a LoadBalancer, using the Strategy registered as
+// method, with its defaults. Unknown methods are an error.
+func NewLoadBalancer(method string) (*LoadBalancer, error) {
+	strategy, err := NewStrategy(method, Route{})
+	if err != nil {
+		return nil, err
+	}
+	return newLoadBalancer(method, strategy), nil
+}
+
+func newLoadBalancer(method string, strategy Strategy) *LoadBalancer {
+	return &LoadBalancer { Count: 0, Requests: 0, Method: method, Strategy: strategy}
+}
+
+// newLoadBalancerFromRoute applies the options of the route, to the balancer.
+func newLoadBalancerFromRoute(apiConfig *sdk.APIContext, Route Route) (*LoadBalancer, error) {
+	strategy, err := NewStrategy(Route.Method, Route)
+	if err != nil {
+		return nil, fmt.Errorf("Route %s: %s", Route.Path, err)
+	}
+	lb := newLoadBalancer(Route.Method, strategy)
+
+	if Route.Outlier != nil {
+		lb.Outlier = NewOutlierDetector(apiConfig, *Route.Outlier)
+	}
+
+	if Route.SlowStart != nil {
+		lb.SlowStart = NewSlowStart(*Route.SlowStart)
+	}
+
+	if Route.Sticky != nil {
+		sticky, err := NewStickySessions(*Route.Sticky)
+		if err != nil {
+			return nil, fmt.Errorf("Route %s: %s", Route.Path, err)
+		}
+		lb.Sticky = sticky
+	}
+
+	if Route.Retry != nil {
+		retry, err := NewRetryPolicy(*Route.Retry)
+		if err != nil {
+			return nil, fmt.Errorf("Route %s: %s", Route.Path, err)
+		}
+		lb.Retry = retry
+	}
+	return lb, nil
 }
 
 func (l *LoadBalancer) AddTargetRule(rule http.Handler) {
+	l.AddBackendTargetRule("", 1, rule)
+}
+
+// AddBackendTargetRule adds the rule, for a named and weighted backend.
+func (l *LoadBalancer) AddBackendTargetRule(backend string, weight int, rule http.Handler) {
 	l.Next[l.Count] = &rule
+	l.Backends[l.Count] = backend
+	l.Weights[l.Count] = int64(weight)
 	l.Count++
+	l.Strategy.BackendAdded(l, l.Count-1)
 }
 
 func (l *LoadBalancer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	l.Requests++
-	if l.Count != 0 {
-		candidate := SelectStrategy(l)
-		(*(l.Next[candidate])).ServeHTTP(res, req)
+	atomic.AddInt64(&l.Requests, 1)
+	if l.Count != 0 && l.Retry != nil && l.Retry.Allows(req) {
+		l.serveWithRetries(res, req)
+	} else if l.Count != 0 {
+		candidate := SelectStrategy(l, req)
+		l.serveBackend(candidate, res, req)
 	} else {
 		res.WriteHeader(http.StatusInternalServerError)
 		status := HTTPStatusCode{http.StatusInternalServerError,
@@ -370,6 +920,35 @@ func (l *LoadBalancer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// serveBackend passes the request on to a backend, counting it in flight.
+// With sticky sessions, the client is pinned to the backend, unless it
+// already is.
+func (l *LoadBalancer) serveBackend(candidate int, res http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&l.InFlight[candidate], 1)
+	defer atomic.AddInt64(&l.InFlight[candidate], -1)
+
+	if l.Sticky != nil {
+		if pinned, ok := l.Sticky.Backend(l, req); !ok || pinned != candidate {
+			res = &stickyResponseWriter{ResponseWriter: res, cookie: l.Sticky.cookie(l, candidate)}
+		}
+	}
+
+	req, outcome := outcomeOf(req)
+	start := time.Now()
+	l.Strategy.RequestStarted(l, candidate, req)
+	defer func() {
+		var latency time.Duration
+		if !outcome.At.IsZero() {
+			latency = outcome.At.Sub(start)
+		}
+		l.Strategy.RequestFinished(l, candidate, req, outcome, latency)
+		if l.Outlier != nil {
+			l.Outlier.Observe(l, candidate, outcome)
+		}
+	}()
+	(*(l.Next[candidate])).ServeHTTP(res, req)
+}
+
 // NCSA Logging Format to log.
 func NCSALogger(next http.HandlerFunc, logToStdout bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -377,7 +956,7 @@ func NCSALogger(next http.HandlerFunc, logToStdout bool) http.HandlerFunc {
 		if logToStdout {
 			t := time.Now()
 
-			interceptWriter := bufferedResponseWriter{w, 0, 0}
+			interceptWriter := bufferedResponseWriter{ResponseWriter: w}
 
 			next.ServeHTTP(&interceptWriter, r)
 
@@ -394,6 +973,19 @@ func NCSALogger(next http.HandlerFunc, logToStdout bool) http.HandlerFunc {
 				time.Since(t),
 			)
 
+			if interceptWriter.Hijacked {
+				log.Printf("%s - %s - - tunnel \"%s %s\" %s in=%d out=%d %s\n",
+					r.URL.Scheme,
+					r.RemoteAddr,
+					r.Method,
+					r.URL.Path,
+					r.Header.Get("Upgrade"),
+					atomic.LoadInt64(&interceptWriter.BytesIn),
+					atomic.LoadInt64(&interceptWriter.BytesOut),
+					time.Since(t),
+				)
+			}
+
 			defer interceptWriter.Flush()
 
 		} else {
@@ -417,52 +1009,39 @@ func EnsureProtocolHeaders(next http.HandlerFunc, Headers []string, Scheme strin
 	}
 }
 
-func FindTargetGroupByRouteExpression(routeexpressions *util.List, req *http.Request) (*RouteExpression, error) {
-
-	rs, err := routeexpressions.Find(func(key *interface{}) bool {
-		RouteExpression := (*key).(RouteExpression)
-		if strings.HasPrefix(fmt.Sprintf("%s://%s%s", req.URL.Scheme,
-			req.Host, req.URL.Path), RouteExpression.Path) {
-			return true
-		}
-		return false
-	})
+// FindTargetGroupByRouteExpression returns the most specific RouteExpression
+// matching scheme://host/path of the request.
+func FindTargetGroupByRouteExpression(routeexpressions *RouteTable, req *http.Request) (*RouteExpression, error) {
 
+	rs, err := routeexpressions.Find(req)
 	if err != nil {
 		return &RouteExpression{}, err
 	}
 
-	rs1 := (*rs).(RouteExpression)
-	return &rs1, err
+	return rs, err
 
 }
 
-func healthcheck(lb *LoadBalancer, apiConfig *sdk.APIContext, path string, expectedStatusCode int) int {
+// sendEvent sends an event, if the api supports it.
+func sendEvent(apiConfig *sdk.APIContext, code int, message string) {
+	if apiConfig == nil {
+		return
+	}
 
 	eventContext := apiConfig.NewEventAPIContext()
-
-        req := httptest.NewRequest("GET", path, nil)
-	res := httptest.NewRecorder()
-        lb.ServeHTTP(res,req)
-
-	if (eventContext.Supports() && res.Code != expectedStatusCode) {
-		event := sdk.NewEvent(1000, "HealthcheckFailed")
+	if eventContext.Supports() {
+		event := sdk.NewEvent(code, message)
 		eventContext.SendEvent(event)
 	}
-
-	return res.Code
-
 }
 
+func LoadConfiguration(apiConfig *sdk.APIContext, Routes []Route, rootList *RouteTable) (error) {
+	generation := atomic.AddInt64(&configGeneration, 1)
 
-func LoadConfiguration(apiConfig *sdk.APIContext, Routes []sdk.Route, rootList *util.List) (error) {
-
-	// start by cleaning all timers
-	timers = timers.Erase(func(key *interface{})  {
-                ticker := (*key).(*time.Ticker)
-		fmt.Printf("Stopping timer %s.\n", ticker)
-		ticker.Stop()
-        })
+	// Balancers by route, registered for runtime weights, and the health
+	// checkers, started once loaded.
+	lbs := make(map[string][]*LoadBalancer)
+	var checkers []*HealthChecker
 
 	// Loadconfiguration, from Routes.
 	for _, Route := range Routes {
@@ -470,30 +1049,60 @@ func LoadConfiguration(apiConfig *sdk.APIContext, Routes []sdk.Route, rootList *
 		// {Type:ProxyTarget Path:http://test.api.comf/api Loadbalancing:round-robin
 		// Backends:[https://www.tuxand.me]}
 		if "proxytarget" == strings.ToLower(Route.Type) {
-			rootRoute := NewRouteExpression(Route.Path)
-			lb := NewLoadBalancer(Route.Method)
+			rootRoute := newRouteExpressionFromRoute(Route)
+			lb, err := newLoadBalancerFromRoute(apiConfig, Route)
+			if err != nil {
+				return err
+			}
 
 			for _, backend := range Route.Backends {
-				lb.AddTargetRule(NewProxyTargetRule(backend, 10))
+				weight, err := backendWeight(Route, backend)
+				if err != nil {
+					return err
+				}
+				lb.AddBackendTargetRule(backend.Backend, weight, newProxyTargetRuleFromRoute(apiConfig, Route, backend))
+			}
+			lbs[routeKey(Route)] = append(lbs[routeKey(Route)], lb)
+
+			lbCheckers, err := newHealthChecks(apiConfig, Route, lb)
+			if err != nil {
+				return err
 			}
+			checkers = append(checkers, lbCheckers...)
+
+			if Route.Predicate != nil {
+				predicate, err := NewPredicate(*Route.Predicate)
+				if err != nil {
+					return fmt.Errorf("Route %s: %s", Route.Path, err)
+				}
 
-			if Route.HealthcheckActive == 1 {
-			  ticker := time.NewTicker(time.Duration(Route.HealthcheckInterval) * time.Second)
-			    go func() {
-				for now := range ticker.C {
-					fmt.Printf("%s %s %s %d==%d.\n",
-						now,
-						rootRoute.Path,
-						Route.HealthcheckPath,
-						healthcheck(lb, apiConfig, Route.HealthcheckPath, Route.HealthcheckStatus),
-						Route.HealthcheckStatus)
+				predicateLb, err := newLoadBalancerFromRoute(apiConfig, Route)
+				if err != nil {
+					return err
 				}
-			    }()
-			  timers.Insert(ticker)
+				for _, backend := range Route.PredicateBackends {
+					weight, err := backendWeight(Route, backend)
+					if err != nil {
+						return err
+					}
+					predicateLb.AddBackendTargetRule(backend.Backend, weight, newProxyTargetRuleFromRoute(apiConfig, Route, backend))
+				}
+				lbs[routeKey(Route)] = append(lbs[routeKey(Route)], predicateLb)
+				predicateCheckers, err := newHealthChecks(apiConfig, Route, predicateLb)
+				if err != nil {
+					return err
+				}
+				checkers = append(checkers, predicateCheckers...)
+				if err := addRouteTargetRule(rootRoute, Route, NewPropositionTargetRule(predicate, predicateLb, lb)); err != nil {
+					return err
+				}
+			} else if err := addRouteTargetRule(rootRoute, Route, lb); err != nil {
+				return err
 			}
 
-			rootRoute.AddTargetRule(lb)
-			rootList.Insert(*rootRoute)
+			if err := rootList.Insert(rootRoute); err != nil {
+				return err
+			}
 		}
 
 		if "apitarget" == strings.ToLower(Route.Type) {
@@ -504,7 +1113,7 @@ func LoadConfiguration(apiConfig *sdk.APIContext, Routes []sdk.Route, rootList *
 			// if we're supposed to check something ourselves.
 			apiProxyIntercept := func(h http.Handler) http.Handler {
 				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					interceptWriter := bufferedResponseWriter{w, 0, 0}
+					interceptWriter := bufferedResponseWriter{ResponseWriter: w}
 					defer interceptWriter.Flush()
 
 					h.ServeHTTP(&interceptWriter, r)
@@ -523,12 +1132,14 @@ func LoadConfiguration(apiConfig *sdk.APIContext, Routes []sdk.Route, rootList *
 						RoutesREST, err := lbConfig.LoadbalancerConfigurationFromRESTApi()
 						if err == nil {
 
-							newRootList  := new(util.List)
-							if err := LoadConfiguration(apiConfig, RoutesREST, newRootList); err != nil {
+							newRootList  := NewRouteTable()
+							if err := LoadConfiguration(apiConfig, RoutesFromSDK(RoutesREST), newRootList); err != nil {
+								log.Printf("Could not reload configuration, keeping the current one, err: %s\n", err)
 								if (eventConfig.Supports()) {
 									event := sdk.NewEvent(400, "Could not load configuration")
 									eventConfig.SendEvent(event)
 								}
+								return
 							}
 
 							// TODO: Change this, to be sent to the event-backend
@@ -548,21 +1159,59 @@ func LoadConfiguration(apiConfig *sdk.APIContext, Routes []sdk.Route, rootList *
 				})
 			}
 
-			rootRoute := NewRouteExpression(Route.Path)
-			lb := NewLoadBalancer(Route.Method)
+			rootRoute := newRouteExpressionFromRoute(Route)
+			lb, err := newLoadBalancerFromRoute(apiConfig, Route)
+			if err != nil {
+				return err
+			}
 			for _, backend := range Route.Backends {
-				apiProxyRoute := NewProxyTargetRule(backend, 10)
-				lb.AddTargetRule(apiProxyIntercept(apiProxyRoute));
+				weight, err := backendWeight(Route, backend)
+				if err != nil {
+					return err
+				}
+				apiProxyRoute := newProxyTargetRuleFromRoute(apiConfig, Route, backend)
+				lb.AddBackendTargetRule(backend.Backend, weight, apiProxyIntercept(apiProxyRoute));
+			}
+			lbs[routeKey(Route)] = append(lbs[routeKey(Route)], lb)
+			if err := addRouteTargetRule(rootRoute, Route, lb); err != nil {
+				return err
+			}
+			if err := rootList.Insert(rootRoute); err != nil {
+				return err
 			}
-			rootRoute.AddTargetRule(lb)
-			rootList.Insert(*rootRoute)
 		}
 
 	}
 
+	// Only now, the old timers, and health checkers, are stopped.
+	timers = timers.Erase(func(key *interface{})  {
+                ticker := (*key).(interface{ Stop() })
+		fmt.Printf("Stopping timer %v.\n", ticker)
+		ticker.Stop()
+        })
+	for _, checker := range checkers {
+		checker.inherit()
+		checker.Start()
+		timers.Insert(checker)
+	}
+
+	registerBalancers(lbs)
+	sweepRegistries(generation)
 	return nil
 }
 
+// backendWeight returns the weight of the backend, 1 unless configured.
+func backendWeight(Route Route, backend sdk.Backend) (int, error) {
+	weight := Route.BackendOptions[backend.Backend].Weight
+	if weight == nil {
+		return 1, nil
+	}
+	if *weight < 0 {
+		return 0, fmt.Errorf("Route %s: negative weight %d for %s", Route.Path, *weight, backend.Backend)
+	}
+	return *weight, nil
+}
+
 func main() {
 
 	host, err := externalIP()
@@ -579,6 +1228,7 @@ func main() {
 	access := flag.String("accesskey", "", "The access-key associated to use")
 	initialJSON := flag.String("initialJSON", "unset", "The initial-configuration to use, encoded as JSON.")
 	scheme  := flag.String("scheme","https", "The scheme this service is serving out")
+	stats := flag.String("stats", "", "Listen description, for the stats-endpoint (ie. 127.0.0.1:8081).")
 
 	flag.Parse()
 
@@ -589,19 +1239,20 @@ func main() {
 	fmt.Printf("Listen :%s, scheme: %s, apiConfiguration: %+v \n", *listen, *scheme,context)
 
 	// Create root-node in graph, and monkey-patch our configuration onto it.
-	var initialRoutes []sdk.Route
+	var initialRoutes []Route
 	if *initialJSON != "unset" {
-		initialRoutes, err = sdk.LoadbalancerConfigurationFromFile(*initialJSON)
+		initialRoutes, err = LoadRoutesFromFile(*initialJSON)
 		if err != nil {
 			fmt.Printf("Could not load configuration. Aborting.")
 			return
 		}
 	} else {
-		initialRoutes, err = context.LoadbalancerConfigurationFromRESTApi()
+		RoutesREST, err := context.LoadbalancerConfigurationFromRESTApi()
 		if err != nil {
 			fmt.Printf("Could not load configuration. Aborting.")
 			return
 		}
+		initialRoutes = RoutesFromSDK(RoutesREST)
 	}
 
 	if err := LoadConfiguration(context, initialRoutes, routeexpressions); err != nil {
@@ -610,6 +1261,16 @@ func main() {
 	}
 
 
+	// Stats are served on their own listener, to keep them off the routes.
+	if *stats != "" {
+		statsMux := http.NewServeMux()
+		statsMux.HandleFunc("/stats", StatsHandler)
+		statsMux.HandleFunc("/weights", WeightsHandler)
+		go func() {
+			log.Fatal(http.ListenAndServe(*stats, statsMux))
+		}()
+	}
+
 	// Start webserver, capture apps and use that.
 	http.HandleFunc("/",
 		NCSALogger(
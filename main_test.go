@@ -1,19 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"github.com/newsworthy39/golang-https-loadbalancer/util"
 	sdk "github.com/newsworthy39/golang-clouddom-sdk"
 )
 
 func TestFindTargetGroupByRouteExpression(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://localhost/test", nil)
 
-	routeexpressions := new(util.List)
-	routeexpressions.Insert (*NewRouteExpression("http://localhost/"))
+	routeexpressions := NewRouteTable()
+	routeexpressions.Insert (NewRouteExpression("http://localhost/"))
 
 	t.Logf("* Testing found functionality, Path: %s, Host: %s\n", req.URL.Path, fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host))
 	rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
@@ -28,8 +38,8 @@ func TestFindTargetGroupByRouteExpression(t *testing.T) {
 func TestNotFindTargetGroupByRouteExpression(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://localhost/", nil)
 
-	routeexpressions := new(util.List)
-	routeexpressions.Insert (*NewRouteExpression("https://localhost/"))
+	routeexpressions := NewRouteTable()
+	routeexpressions.Insert (NewRouteExpression("https://localhost/"))
 
 	t.Logf("* Testing not-found functionality, Path: %s, Host: %s\n", req.URL.Path, fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host))
 	rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
@@ -45,10 +55,10 @@ func TestCacheRulesFindTargetGroupByRouteExpression(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://localhost/", nil)
 	res := httptest.NewRecorder()
 
-	routeexpressions := new(util.List)
+	routeexpressions := NewRouteTable()
 	route := NewRouteExpression("http://localhost/")
 	route.AddTargetRule(NewContentTargetRule("This is the end"))
-	routeexpressions.Insert (*route)
+	routeexpressions.Insert (route)
 
 	t.Logf("* Testing Rule chain, Path: %s, Host: %s\n", req.URL.Path, fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host))
 	rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
@@ -70,10 +80,10 @@ func TestProxyRulesFindTargetGroupByRouteExpression(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://localhost/", nil)
 	res := httptest.NewRecorder()
 
-	routeexpressions := new(util.List)
+	routeexpressions := NewRouteTable()
 	route := NewRouteExpression("http://localhost/")
 	route.AddTargetRule(NewProxyTargetRule(sdk.Backend { Backend: "https://www.tuxand.me" }, 10))
-	routeexpressions.Insert (*route)
+	routeexpressions.Insert (route)
 
 	t.Logf("* Testing Rule chain, Path: %s, Host: %s\n", req.URL.Path, fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host))
 	rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
@@ -95,10 +105,10 @@ func TestRedirectTargetRule(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://localhost/", nil)
 	res := httptest.NewRecorder()
 
-	routeexpressions := new(util.List)
+	routeexpressions := NewRouteTable()
 	route := NewRouteExpression("http://localhost/")
 	route.AddTargetRule(NewRedirectTargetRule("https://www.tuxand.me", 301))
-	routeexpressions.Insert (*route)
+	routeexpressions.Insert (route)
 
 	t.Logf("* Testing Rule chain, Path: %s, Host: %s\n", req.URL.Path, fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host))
 	rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
@@ -121,10 +131,10 @@ func TestCacheTargetRule(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://localhost/cache", nil)
 	res := httptest.NewRecorder()
 
-	routeexpressions := new(util.List)
+	routeexpressions := NewRouteTable()
 	route := NewRouteExpression("http://localhost/cache")
 	route.AddTargetRule(NewCacheTargetRule(sdk.Backend { Backend: "http://www.tuxand.me" }))
-	routeexpressions.Insert (*route)
+	routeexpressions.Insert (route)
 
 	t.Logf("* Testing Rule chain, Path: %s, Host: %s\n", req.URL.Path, fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host))
 	rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
@@ -141,3 +151,1633 @@ func TestCacheTargetRule(t *testing.T) {
 	t.Logf("Content-Type: %s\n", resp.Header.Get("Content-Type"))
 	t.Logf("Body: %s\n", string(body))
 }
+
+func TestMostSpecificRouteExpression(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost/api/users", nil)
+
+	routeexpressions := NewRouteTable()
+	routeexpressions.Insert(NewRouteExpression("http://localhost/api"))
+	routeexpressions.Insert(NewRouteExpression("http://localhost/"))
+	routeexpressions.Insert(NewRouteExpression("http://localhost/api/users/admin"))
+
+	rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
+	if err != nil {
+		t.Fatalf("Did not find proper %s", err)
+	}
+	if rs.Path != "http://localhost/api" {
+		t.Errorf("Expected http://localhost/api, got %s", rs.Path)
+	}
+
+	// Prefixes match whole path segments.
+	req = httptest.NewRequest("GET", "http://localhost/apiary", nil)
+	rs, err = FindTargetGroupByRouteExpression(routeexpressions, req)
+	if err != nil || rs.Path != "http://localhost/" {
+		t.Errorf("Expected http://localhost/ for /apiary, got %+v %s", rs, err)
+	}
+
+	// Prefix semantics are kept as fallback, for routes not ending at a host.
+	routeexpressions.Insert(NewRouteExpression("http://local"))
+	req = httptest.NewRequest("GET", "http://localhost.localdomain/", nil)
+	rs, err = FindTargetGroupByRouteExpression(routeexpressions, req)
+	if err != nil || rs.Path != "http://local" {
+		t.Errorf("Expected fallback http://local, got %+v %s", rs, err)
+	}
+
+	// And for prefixes ending mid-segment, when no route matches whole ones.
+	routeexpressions = NewRouteTable()
+	routeexpressions.Insert(NewRouteExpression("http://localhost/ap"))
+	req = httptest.NewRequest("GET", "http://localhost/api", nil)
+	rs, err = FindTargetGroupByRouteExpression(routeexpressions, req)
+	if err != nil || rs.Path != "http://localhost/ap" {
+		t.Errorf("Expected fallback http://localhost/ap, got %+v %s", rs, err)
+	}
+
+	// Routes of scheme://host paths only match the default port, as before.
+	routeexpressions = NewRouteTable()
+	routeexpressions.Insert(NewRouteExpression("http://localhost/"))
+	for host, found := range map[string]bool{"localhost": true, "localhost:80": true, "localhost:8080": false} {
+		req = httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Host = host
+		if _, err := FindTargetGroupByRouteExpression(routeexpressions, req); (err == nil) != found {
+			t.Errorf("Host %s, expected found %t, got %v", host, found, err)
+		}
+	}
+}
+
+func TestVirtualHostRouteExpression(t *testing.T) {
+	routeexpressions := NewRouteTable()
+	routeexpressions.Insert(NewHostRouteExpression([]string{"api.example.com"}, "/"))
+	routeexpressions.Insert(NewHostRouteExpression([]string{"*.example.com"}, "/"))
+	routeexpressions.Insert(NewHostRouteExpression([]string{"*.tenants.example.com"}, "/"))
+	routeexpressions.Insert(NewHostRouteExpression([]string{"admin.example.com:8443"}, "/"))
+	routeexpressions.Insert(NewHostRouteExpression([]string{"secure.example.com:443"}, "/"))
+	routeexpressions.Insert(NewHostRouteExpression([]string{"*"}, "/"))
+
+	tests := []struct {
+		url  string
+		host string
+		want string
+	}{
+		{"https://api.example.com/", "API.Example.com:443", "api.example.com"},
+		{"https://www.example.com/", "www.example.com", "*.example.com"},
+		{"https://a.tenants.example.com/", "a.tenants.example.com.", "*.tenants.example.com"},
+		{"https://admin.example.com/", "admin.example.com:8443", "admin.example.com:8443"},
+		{"https://admin.example.com/", "admin.example.com", "*.example.com"},
+		{"https://secure.example.com/", "secure.example.com:443", "secure.example.com:443"},
+		{"https://secure.example.com/", "secure.example.com", "secure.example.com:443"},
+		{"http://secure.example.com/", "secure.example.com", "*.example.com"},
+		{"https://example.com/", "example.com", "*"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Host = test.host
+		rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
+		if err != nil {
+			t.Fatalf("Did not find proper %s, %s", test.host, err)
+		}
+		if rs.Hosts[0] != test.want {
+			t.Errorf("Host %s, expected %s, got %s", test.host, test.want, rs.Hosts[0])
+		}
+	}
+}
+
+func TestPatternRouteExpression(t *testing.T) {
+	routeexpressions := NewRouteTable()
+	routeexpressions.Insert(NewHostRouteExpression([]string{"*"}, "/users/"))
+	routeexpressions.Insert(NewHostRouteExpression([]string{"*"}, "/users/{id}/orders"))
+	routeexpressions.Insert(NewHostRouteExpression([]string{"*"}, "~^/v[0-9]+/"))
+	routeexpressions.Insert(NewRouteExpression("http://localhost/items/{item:[0-9]+}"))
+
+	tests := []struct {
+		url    string
+		want   string
+		params map[string]string
+	}{
+		{"http://example.com/users/42/orders", "/users/{id}/orders", map[string]string{"id": "42", "1": "42"}},
+		{"http://example.com/users/42", "/users/", nil},
+		{"http://example.com/users/42/ordersarchive", "/users/", nil},
+		{"http://example.com/v2/status", "~^/v[0-9]+/", nil},
+		{"http://localhost/items/7", "http://localhost/items/{item:[0-9]+}", map[string]string{"item": "7"}},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		rs, err := FindTargetGroupByRouteExpression(routeexpressions, req)
+		if err != nil {
+			t.Fatalf("Did not find proper %s, %s", test.url, err)
+		}
+		if rs.Path != test.want {
+			t.Errorf("%s, expected %s, got %s", test.url, test.want, rs.Path)
+		}
+		match, _ := rs.Match(req.URL.Path)
+		for name, value := range test.params {
+			if match.Params[name] != value {
+				t.Errorf("%s, expected %s=%s, got %+v", test.url, name, value, match.Params)
+			}
+		}
+	}
+
+	// The prefix of a template ends with its last segment.
+	route := NewHostRouteExpression([]string{"*"}, "/users/{id}/orders")
+	route.Compile()
+	if match, ok := route.Match("/users/42/orders/7"); !ok || match.Prefix != "/users/42/orders" {
+		t.Errorf("Expected prefix /users/42/orders, got %+v", match)
+	}
+
+	if err := routeexpressions.Insert(NewRouteExpression("http://localhost~^/(")); err == nil {
+		t.Errorf("Expected invalid regular expression to fail")
+	}
+}
+
+func TestRedirectTargetRuleRouteParams(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost/users/42", nil)
+	res := httptest.NewRecorder()
+
+	route := NewRouteExpression("http://localhost/users/{id}")
+	route.Compile()
+	route.AddTargetRule(NewRedirectTargetRule("https://www.tuxand.me/profile/{id}", 301))
+	route.ServeHTTP(res, req)
+
+	if location := res.Result().Header.Get("Location"); location != "https://www.tuxand.me/profile/42" {
+		t.Errorf("Expected expanded Location, got %s", location)
+	}
+}
+
+func TestPropositionTargetRule(t *testing.T) {
+	predicate, err := NewPredicate(PredicateConfig{Type: "or", Predicates: []PredicateConfig{
+		{Type: "header", Name: "User-Agent", Match: "(?i)mobile|android|iphone"},
+		{Type: "and", Predicates: []PredicateConfig{
+			{Type: "method", Values: []string{"POST"}},
+			{Type: "not", Predicates: []PredicateConfig{{Type: "cidr", Values: []string{"10.0.0.0/8"}}}},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("Could not build predicate %s", err)
+	}
+
+	rule := NewPropositionTargetRule(predicate, NewContentTargetRule("pool B"), NewContentTargetRule("pool A"))
+
+	tests := []struct {
+		method     string
+		userAgent  string
+		remoteAddr string
+		want       string
+	}{
+		{"GET", "Mozilla/5.0 (iPhone; CPU iPhone OS 12_0)", "10.0.0.1:1234", "pool B"},
+		{"GET", "Mozilla/5.0 (X11; Linux x86_64)", "10.0.0.1:1234", "pool A"},
+		{"POST", "curl/7.58", "192.168.1.1:1234", "pool B"},
+		{"POST", "curl/7.58", "10.1.2.3:1234", "pool A"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://localhost/", nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		req.RemoteAddr = test.remoteAddr
+		res := httptest.NewRecorder()
+
+		rule.ServeHTTP(res, req)
+		if body := res.Body.String(); body != test.want {
+			t.Errorf("%s %s %s, expected %s, got %s", test.method, test.userAgent, test.remoteAddr, test.want, body)
+		}
+	}
+
+	// A missing branch answers 503, rather than panicking.
+	var missing *LoadBalancer
+	rule = NewPropositionTargetRule(predicate, nil, missing)
+	res := httptest.NewRecorder()
+	rule.ServeHTTP(res, httptest.NewRequest("GET", "http://localhost/", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a target, got %d", res.Code)
+	}
+
+	if _, err := NewPredicate(PredicateConfig{Type: "weather"}); err == nil {
+		t.Errorf("Expected unknown predicate type to fail")
+	}
+}
+
+func TestProxyTargetRuleBackendURL(t *testing.T) {
+	tests := []struct {
+		target      string
+		route       string
+		url         string
+		stripPrefix bool
+		want        string
+	}{
+		{"http://backend", "http://localhost/", "http://localhost/search?q=golang&page=2", false, "http://backend/search?q=golang&page=2"},
+		{"http://backend:8080/maybethis", "http://localhost/", "http://localhost/api/users", false, "http://backend:8080/maybethis/api/users"},
+		{"http://backend/base/", "http://localhost/api", "http://localhost/api/users?id=1", true, "http://backend/base/users?id=1"},
+		{"http://backend/?key=secret", "http://localhost/", "http://localhost/a%2Fb?x=1", false, "http://backend/a%2Fb?key=secret&x=1"},
+		{"http://backend", "http://localhost/files", "http://localhost/files/a%2Fb", true, "http://backend/a%2Fb"},
+		{"http://backend", "http://localhost/api", "http://localhost/api", true, "http://backend/"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		route := NewRouteExpression(test.route)
+		route.Compile()
+		match, _ := route.Match(req.URL.Path)
+		req = req.WithContext(context.WithValue(req.Context(), routeMatchKey{}, match))
+
+		proxy := NewProxyTargetRule(sdk.Backend{Backend: test.target}, 10)
+		if got := backendURL(proxy.target, req, test.stripPrefix).String(); got != test.want {
+			t.Errorf("%s via %s, expected %s, got %s", test.url, test.target, test.want, got)
+		}
+	}
+}
+
+func TestRewriteTargetRule(t *testing.T) {
+	tests := []struct {
+		config RewriteConfig
+		url    string
+		path   string
+		host   string
+	}{
+		{RewriteConfig{StripPrefix: "/billing", Host: "billing-svc"}, "http://localhost/billing/invoices/1", "/invoices/1", "billing-svc"},
+		{RewriteConfig{AddPrefix: "/legacy"}, "http://localhost/users", "/legacy/users", ""},
+		{RewriteConfig{Match: "^/v([0-9]+)/(.*)$", Replace: "/api/$2/v$1", PreserveHost: true}, "http://localhost/v2/status", "/api/status/v2", "localhost"},
+		{RewriteConfig{StripPrefix: "/files"}, "http://localhost/files/a%2Fb", "/a%2Fb", ""},
+	}
+
+	for _, test := range tests {
+		rewrite, err := NewRewriteTargetRule(test.config)
+		if err != nil {
+			t.Fatalf("Could not build rewrite %s", err)
+		}
+
+		var path, host string
+		rewrite.AddTargetRule(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			path = req.URL.EscapedPath()
+			host, _ = rewrittenHost(req)
+		}))
+		rewrite.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.url, nil))
+
+		if path != test.path || host != test.host {
+			t.Errorf("%s, expected %s %s, got %s %s", test.url, test.path, test.host, path, host)
+		}
+	}
+}
+
+func TestProxyTargetRuleForwardHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received = req.Header
+		res.Header().Set("Connection", "X-Internal")
+		res.Header().Set("X-Internal", "secret")
+		res.Header().Set("Set-Cookie", "session=1")
+		res.Header().Set("Server", "legacy/1.0")
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyTargetRule(sdk.Backend{Backend: backend.URL}, 10)
+	proxy.DenyHeaders = []string{"Server"}
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Connection", "keep-alive, X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	res := httptest.NewRecorder()
+
+	proxy.ServeHTTP(res, req)
+
+	for _, name := range []string{"Authorization", "Cookie", "Accept"} {
+		if received.Get(name) != req.Header.Get(name) {
+			t.Errorf("Expected %s to be forwarded, got %q", name, received.Get(name))
+		}
+	}
+	for _, name := range []string{"X-Hop", "Keep-Alive"} {
+		if received.Get(name) != "" {
+			t.Errorf("Expected hop-by-hop %s to be removed, got %q", name, received.Get(name))
+		}
+	}
+	if forwarded := received.Get("X-Forwarded-For"); forwarded != "10.0.0.1, 192.0.2.1" {
+		t.Errorf("Expected X-Forwarded-For to be appended, got %s", forwarded)
+	}
+
+	header := res.Result().Header
+	if header.Get("X-Internal") != "" || header.Get("Server") != "" || header.Get("Set-Cookie") == "" {
+		t.Errorf("Expected response headers filtered, got %+v", header)
+	}
+}
+
+func TestProxyTargetRuleStreamsResponse(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.WriteHeader(http.StatusOK)
+		fmt.Fprintf(res, "data: first\n\n")
+		res.(http.Flusher).Flush()
+		<-release
+		fmt.Fprintf(res, "data: second\n\n")
+	}))
+	defer backend.Close()
+
+	proxy := httptest.NewServer(NewProxyTargetRule(sdk.Backend{Backend: backend.URL}, 10))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("Could not get %s", err)
+	}
+	defer resp.Body.Close()
+	defer close(release)
+
+	// The first event must arrive, while the backend is still blocked.
+	buf := make([]byte, len("data: first\n\n"))
+	done := make(chan error)
+	go func() {
+		_, err := io.ReadFull(resp.Body, buf)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil || string(buf) != "data: first\n\n" {
+			t.Errorf("Expected first event, got %q %s", buf, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Response was not streamed")
+	}
+}
+
+func TestProxyTargetRuleUpgradeTunnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if upgradeType(req.Header) != "echo" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := res.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+
+		line, _ := brw.ReadString('\n')
+		brw.WriteString("echo: " + line)
+		brw.Flush()
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyTargetRule(sdk.Backend{Backend: backend.URL}, 10)
+	var logged *bufferedResponseWriter
+	frontend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		logged = &bufferedResponseWriter{ResponseWriter: res}
+		proxy.ServeHTTP(logged, req)
+	}))
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not dial %s", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %+v %s", resp, err)
+	}
+
+	fmt.Fprintf(conn, "hello\n")
+	if line, _ := reader.ReadString('\n'); line != "echo: hello\n" {
+		t.Errorf("Expected echo through tunnel, got %q", line)
+	}
+	conn.Close()
+
+	// The tunnel ends, when the backend closes.
+	deadline := time.Now().Add(5 * time.Second)
+	for proxy.ActiveConnections() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if proxy.ActiveConnections() != 0 || !logged.Hijacked || atomic.LoadInt64(&logged.BytesIn) != 6 {
+		t.Errorf("Expected closed and counted tunnel, got %d active, %+v", proxy.ActiveConnections(), logged)
+	}
+
+	// Switching to another protocol is a failure of the backend.
+	other := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		conn, brw, err := res.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: other\r\n\r\n")
+		brw.Flush()
+	}))
+	defer other.Close()
+
+	req, outcome := withOutcome(httptest.NewRequest("GET", "http://localhost/", nil))
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	res := httptest.NewRecorder()
+	NewProxyTargetRule(sdk.Backend{Backend: other.URL}, 10).ServeHTTP(res, req)
+	if res.Code != http.StatusBadGateway || outcome.StatusCode != http.StatusBadGateway || outcome.Reason != "protocol switch" {
+		t.Errorf("Expected the switch recorded as 502, got %d %+v", res.Code, outcome)
+	}
+}
+
+func TestProxyTargetRuleBackendFailed(t *testing.T) {
+	// Find a port, nothing is listening on.
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := listener.Addr().String()
+	listener.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	tests := []struct {
+		backend string
+		timeout time.Duration
+		want    int
+	}{
+		{"http://" + refused, 0, http.StatusServiceUnavailable},
+		{"http://backend.invalid", 0, http.StatusBadGateway},
+		{slow.URL, 50 * time.Millisecond, http.StatusGatewayTimeout},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		if test.timeout > 0 {
+			ctx, cancel := context.WithTimeout(req.Context(), test.timeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		res := httptest.NewRecorder()
+
+		NewProxyTargetRule(sdk.Backend{Backend: test.backend}, 10).ServeHTTP(res, req)
+		if res.Code != test.want {
+			t.Errorf("%s, expected %d, got %d", test.backend, test.want, res.Code)
+		}
+	}
+}
+
+func TestProxyTargetRuleTimeouts(t *testing.T) {
+	timeout := make(chan string, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		timeout <- req.Header.Get("X-Request-Timeout-Ms")
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	route := Route{Timeouts: &TimeoutConfig{ResponseHeader: 5000, Total: 1000},
+		BackendOptions: map[string]BackendOptions{slow.URL: {Timeouts: &TimeoutConfig{ResponseHeader: 50}}}}
+	route.Type = "proxytarget"
+
+	proxy := newProxyTargetRuleFromRoute(nil, route, sdk.Backend{Backend: slow.URL})
+	if proxy.Timeouts.ResponseHeader != 50*time.Millisecond || proxy.Timeouts.Total != time.Second {
+		t.Errorf("Expected backend override, got %+v", proxy.Timeouts)
+	}
+
+	res := httptest.NewRecorder()
+	proxy.ServeHTTP(res, httptest.NewRequest("GET", "http://localhost/", nil))
+	if res.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504, got %d", res.Code)
+	}
+	if propagated := <-timeout; propagated == "" {
+		t.Errorf("Expected deadline to be propagated")
+	}
+
+	if status, reason := classifyBackendError(errors.New("net/http: timeout awaiting response headers")); status != http.StatusGatewayTimeout || reason != "timeout=header" {
+		t.Errorf("Expected timeout=header, got %d %s", status, reason)
+	}
+}
+
+func TestLoadBalancerRetries(t *testing.T) {
+	var failedAttempts int64
+	failing := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&failedAttempts, 1)
+		res.Header().Set("X-Backend", "failing")
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		res.Header().Set("X-Backend", "healthy")
+		res.Write(body)
+	}))
+	defer healthy.Close()
+
+	retry, err := NewRetryPolicy(RetryConfig{Attempts: 2})
+	if err != nil {
+		t.Fatalf("Could not build retry policy %s", err)
+	}
+
+	lb, _ := NewLoadBalancer("round-robin")
+	lb.Retry = retry
+	lb.AddTargetRule(NewProxyTargetRule(sdk.Backend{Backend: failing.URL}, 10))
+	lb.AddTargetRule(NewProxyTargetRule(sdk.Backend{Backend: healthy.URL}, 10))
+
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("PUT", "http://localhost/", strings.NewReader("payload"))
+		res := httptest.NewRecorder()
+		lb.ServeHTTP(res, req)
+
+		if res.Code != http.StatusOK || res.Header().Get("X-Backend") != "healthy" || res.Body.String() != "payload" {
+			t.Errorf("Expected retry on healthy backend, got %d %s %q", res.Code, res.Header().Get("X-Backend"), res.Body.String())
+		}
+	}
+	if atomic.LoadInt64(&failedAttempts) == 0 {
+		t.Errorf("Expected the failing backend to be tried")
+	}
+
+	// Non-idempotent methods are not retried, by default.
+	codes := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "http://localhost/", strings.NewReader("payload"))
+		res := httptest.NewRecorder()
+		lb.ServeHTTP(res, req)
+		codes[res.Code] = true
+	}
+	if !codes[http.StatusServiceUnavailable] {
+		t.Errorf("Expected POST not to be retried, got %+v", codes)
+	}
+
+	if _, err := NewRetryPolicy(RetryConfig{RetryOn: []string{"sometimes"}}); err == nil {
+		t.Errorf("Expected unknown retry condition to fail")
+	}
+}
+
+func TestBackendPoolConcurrency(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		res.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	route := Route{Pool: &PoolConfig{MaxConnections: 4}}
+	lb, _ := NewLoadBalancer("round-robin")
+	lb.AddTargetRule(newProxyTargetRuleFromRoute(nil, route, sdk.Backend{Backend: backend.URL}))
+	lb.AddTargetRule(newProxyTargetRuleFromRoute(nil, route, sdk.Backend{Backend: backend.URL}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := httptest.NewRecorder()
+			lb.ServeHTTP(res, httptest.NewRequest("GET", "http://localhost/", nil))
+			if res.Code != http.StatusOK {
+				t.Errorf("Expected 200, got %d", res.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var found bool
+	for _, stats := range AllPoolStats() {
+		if stats.Backend != backend.URL || stats.MaxConnections != 4 {
+			continue
+		}
+		found = true
+		if stats.TotalRequests != 50 || stats.ActiveRequests != 0 || stats.OpenConnections > 4 {
+			t.Errorf("Expected one shared, limited pool, got %+v", stats)
+		}
+	}
+	if !found {
+		t.Errorf("Expected pool stats for %s", backend.URL)
+	}
+
+	// Reloading with other limits drops the pool, no longer used.
+	pooled := func(max int) bool {
+		for _, stats := range AllPoolStats() {
+			if stats.Backend == "http://reloaded:8080" && stats.MaxConnections == max {
+				return true
+			}
+		}
+		return false
+	}
+	reloaded := Route{Pool: &PoolConfig{MaxConnections: 2}}
+	reloaded.Type, reloaded.Path = "proxytarget", "http://pools.test/"
+	reloaded.Backends = []sdk.Backend{{Backend: "http://reloaded:8080"}}
+	for _, max := range []int{2, 3} {
+		reloaded.Pool.MaxConnections = max
+		if err := LoadConfiguration(nil, []Route{reloaded}, NewRouteTable()); err != nil {
+			t.Fatalf("Expected configuration to load, got %s", err)
+		}
+	}
+	if pooled(2) || !pooled(3) {
+		t.Errorf("Expected only the pool of the configuration loaded, got %+v", AllPoolStats())
+	}
+	registerBalancers(map[string][]*LoadBalancer{})
+}
+
+func TestProxyTargetRuleConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-release
+		res.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// Rules of the same backend, as on other routes, share the limit.
+	var rules [2]*ProxyTargetRule
+	for i := range rules {
+		rules[i] = NewProxyTargetRule(sdk.Backend{Backend: backend.URL}, 2)
+		rules[i].MaxQueue = 1
+		rules[i].QueueTimeout = 200 * time.Millisecond
+	}
+	proxy := rules[0]
+
+	serve := func() *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		proxy.ServeHTTP(res, httptest.NewRequest("GET", "http://localhost/", nil))
+		return res
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := serve(); res.Code != http.StatusOK {
+				t.Errorf("Expected 200, got %d", res.Code)
+			}
+		}()
+	}
+	<-entered
+	<-entered
+
+	// The third waits in the queue, and times out.
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() { queued <- serve() }()
+	for {
+		if _, waiting := proxy.limiter.Stats(); waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The fourth, through the other rule, finds the queue full.
+	res := httptest.NewRecorder()
+	rules[1].ServeHTTP(res, httptest.NewRequest("GET", "http://localhost/", nil))
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After, when the queue is full, got %d %q", res.Code, res.Header().Get("Retry-After"))
+	}
+	if res := <-queued; res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, when the queue times out, got %d", res.Code)
+	}
+
+	// A queued request gets the slot, as soon as one is released.
+	go func() { queued <- serve() }()
+	for {
+		if _, waiting := proxy.limiter.Stats(); waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if res := <-queued; res.Code != http.StatusOK {
+		t.Errorf("Expected the queued request to be served, got %d", res.Code)
+	}
+	wg.Wait()
+
+	if active, waiting := proxy.limiter.Stats(); active != 0 || waiting != 0 {
+		t.Errorf("Expected all slots released, got %d active, %d waiting", active, waiting)
+	}
+}
+
+func TestLeastConnectionsStrategy(t *testing.T) {
+	lb, _ := NewLoadBalancer("least-connections")
+	for i := 0; i < 3; i++ {
+		lb.AddTargetRule(NewContentTargetRule(fmt.Sprintf("%d", i)))
+	}
+
+	lb.InFlight[0], lb.InFlight[1], lb.InFlight[2] = 3, 1, 2
+	for i := 0; i < 10; i++ {
+		if candidate := SelectStrategy(lb, nil); candidate != 1 {
+			t.Errorf("Expected the least busy backend 1, got %d", candidate)
+		}
+	}
+
+	// Ties are broken randomly.
+	lb.InFlight[0], lb.InFlight[1], lb.InFlight[2] = 1, 5, 1
+	picked := make(map[int]int)
+	for i := 0; i < 200; i++ {
+		picked[SelectStrategy(lb, nil)]++
+	}
+	if picked[1] != 0 || picked[0] == 0 || picked[2] == 0 {
+		t.Errorf("Expected ties between 0 and 2 broken randomly, got %v", picked)
+	}
+
+	// Requests avoid a backend, that is stuck on a slow request.
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	var served int64
+	fast := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&served, 1)
+	}))
+	defer fast.Close()
+
+	lb, _ = NewLoadBalancer("least-connections")
+	lb.AddTargetRule(NewProxyTargetRule(sdk.Backend{Backend: slow.URL}, 0))
+	lb.AddTargetRule(NewProxyTargetRule(sdk.Backend{Backend: fast.URL}, 0))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.serveBackend(0, httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	}()
+	for atomic.LoadInt64(&lb.InFlight[0]) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	}
+	close(release)
+	<-done
+
+	if served != 10 {
+		t.Errorf("Expected all 10 requests on the fast backend, got %d", served)
+	}
+	if inflight := atomic.LoadInt64(&lb.InFlight[0]); inflight != 0 {
+		t.Errorf("Expected no requests in flight, got %d", inflight)
+	}
+}
+
+func TestSmoothWeightedRoundRobinStrategy(t *testing.T) {
+	lb, _ := NewLoadBalancer("weighted-round-robin")
+	lb.AddBackendTargetRule("a", 5, NewContentTargetRule("a"))
+	lb.AddBackendTargetRule("b", 1, NewContentTargetRule("b"))
+	lb.AddBackendTargetRule("c", 1, NewContentTargetRule("c"))
+
+	var picked string
+	for i := 0; i < 7; i++ {
+		picked += lb.Backends[SelectStrategy(lb, nil)]
+	}
+	if picked != "aabacaa" {
+		t.Errorf("Expected the smooth sequence aabacaa, got %s", picked)
+	}
+
+	// Draining a backend, takes it out of rotation.
+	if !lb.SetWeight("a", 0) || lb.SetWeight("d", 1) {
+		t.Errorf("Expected SetWeight to find a, and not d")
+	}
+	picked = ""
+	for i := 0; i < 4; i++ {
+		picked += lb.Backends[SelectStrategy(lb, nil)]
+	}
+	if strings.Contains(picked, "a") {
+		t.Errorf("Expected a to be drained, got %s", picked)
+	}
+}
+
+func TestWeightsHandler(t *testing.T) {
+	weight := 0
+	route := Route{BackendOptions: map[string]BackendOptions{"http://drained:8080": {Weight: &weight}}}
+	route.Type, route.Path, route.Method = "proxytarget", "http://weights.test/api", "weighted-round-robin"
+	route.Backends = []sdk.Backend{{Backend: "http://live:8080"}, {Backend: "http://drained:8080"}}
+
+	if err := LoadConfiguration(nil, []Route{route}, NewRouteTable()); err != nil {
+		t.Fatalf("Expected configuration to load, got %s", err)
+	}
+
+	weights := func() map[string]int64 {
+		m := make(map[string]int64)
+		for _, w := range AllWeights() {
+			if w.Route == route.Path {
+				m[w.Backend] = w.Weight
+			}
+		}
+		return m
+	}
+	if w := weights(); w["http://live:8080"] != 1 || w["http://drained:8080"] != 0 {
+		t.Errorf("Expected configured weights, got %v", w)
+	}
+
+	res := httptest.NewRecorder()
+	WeightsHandler(res, httptest.NewRequest("POST", "/weights?route=http://weights.test/api&backend=http://drained:8080&weight=9", nil))
+	if res.Code != http.StatusOK || weights()["http://drained:8080"] != 9 {
+		t.Errorf("Expected weight set at runtime, got %d %v", res.Code, weights())
+	}
+
+	res = httptest.NewRecorder()
+	WeightsHandler(res, httptest.NewRequest("POST", "/weights?backend=http://unknown:8080&weight=1", nil))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown backend, got %d", res.Code)
+	}
+
+	// Routes on different Hosts, sharing their Path, are weighed apart.
+	tenants := []Route{route, route}
+	tenants[0].Hosts, tenants[1].Hosts = []string{"a.weights.test"}, []string{"b.weights.test"}
+	tenants[0].Path, tenants[1].Path = "/", "/"
+	if err := LoadConfiguration(nil, tenants, NewRouteTable()); err != nil {
+		t.Fatalf("Expected configuration to load, got %s", err)
+	}
+	res = httptest.NewRecorder()
+	WeightsHandler(res, httptest.NewRequest("POST", "/weights?route=a.weights.test/&backend=http://live:8080&weight=5", nil))
+	for _, w := range AllWeights() {
+		if w.Backend == "http://live:8080" && w.Weight != map[string]int64{"a.weights.test/": 5, "b.weights.test/": 1}[w.Route] {
+			t.Errorf("Expected only a.weights.test/ reweighed, got %+v", w)
+		}
+	}
+
+	weight = -1
+	if err := LoadConfiguration(nil, []Route{route}, NewRouteTable()); err == nil {
+		t.Errorf("Expected a negative weight to be rejected")
+	}
+}
+
+func TestConsistentHashStrategy(t *testing.T) {
+	build := func(backends ...string) *LoadBalancer {
+		route := Route{HashKey: "header:X-User"}
+		route.Method = "consistent-hash"
+		lb, err := newLoadBalancerFromRoute(nil, route)
+		if err != nil {
+			t.Fatalf("Expected a load balancer, got %s", err)
+		}
+		for _, backend := range backends {
+			lb.AddBackendTargetRule(backend, 1, NewContentTargetRule(backend))
+		}
+		return lb
+	}
+	owner := func(lb *LoadBalancer, user string) string {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("X-User", user)
+		return lb.Backends[SelectStrategy(lb, req)]
+	}
+
+	five := build("a", "b", "c", "d", "e")
+	four := build("a", "b", "c", "d")
+
+	moved, counts := 0, make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		before, after := owner(five, user), owner(four, user)
+		counts[before]++
+		if owner(five, user) != before {
+			t.Fatalf("Expected %s to hash to the same backend", user)
+		}
+		if before != "e" && before != after {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Errorf("Expected only keys of the removed backend to move, %d others did", moved)
+	}
+	for _, backend := range []string{"a", "b", "c", "d", "e"} {
+		if counts[backend] < 200 || counts[backend] > 600 {
+			t.Errorf("Expected keys spread evenly, got %v", counts)
+			break
+		}
+	}
+
+	// Draining a backend moves its keys only.
+	five.SetWeight("e", 0)
+	for i := 0; i < 200; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		if a, b := owner(five, user), owner(four, user); a != b {
+			t.Errorf("Expected drained ring to match the ring without e, %s went to %s and %s", user, a, b)
+		}
+	}
+
+	if _, err := NewHashKey("header:"); err == nil {
+		t.Errorf("Expected a header hash key without a name, to be rejected")
+	}
+	if _, err := NewHashKey("body"); err == nil {
+		t.Errorf("Expected an unknown hash key, to be rejected")
+	}
+}
+
+func TestStickySessions(t *testing.T) {
+	route := Route{Sticky: &StickyConfig{Cookie: "pin", TTL: 60, HttpOnly: true, Secure: true, SameSite: "strict", Secret: "s3cret"}}
+	lb, err := newLoadBalancerFromRoute(nil, route)
+	if err != nil {
+		t.Fatalf("Expected a load balancer, got %s", err)
+	}
+	for _, backend := range []string{"http://a:8080", "http://b:8080", "http://c:8080"} {
+		lb.AddBackendTargetRule(backend, 1, NewContentTargetRule(backend))
+	}
+
+	serve := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		lb.ServeHTTP(res, req)
+		cookies := res.Result().Cookies()
+		if len(cookies) == 0 {
+			return res.Body.String(), nil
+		}
+		return res.Body.String(), cookies[0]
+	}
+
+	first, cookie := serve(nil)
+	if cookie == nil || cookie.Name != "pin" || !cookie.HttpOnly || !cookie.Secure ||
+		cookie.SameSite != http.SameSiteStrictMode || cookie.MaxAge != 60 {
+		t.Fatalf("Expected a configured sticky cookie, got %+v", cookie)
+	}
+	if strings.Contains(cookie.Value, "8080") {
+		t.Errorf("Expected the cookie not to reveal the backend, got %s", cookie.Value)
+	}
+
+	for i := 0; i < 5; i++ {
+		backend, again := serve(cookie)
+		if backend != first {
+			t.Errorf("Expected the client pinned to %s, got %s", first, backend)
+		}
+		if again != nil {
+			t.Errorf("Expected no new cookie, while pinned")
+		}
+	}
+
+	// A tampered cookie is ignored.
+	other := "http://a:8080"
+	if first == other {
+		other = "http://b:8080"
+	}
+	tampered := *cookie
+	tampered.Value = fmt.Sprintf("%016x", hashString(other)) + cookie.Value[16:]
+	if _, again := serve(&tampered); again == nil {
+		t.Errorf("Expected a tampered cookie to be replaced")
+	}
+
+	// An unhealthy backend loses its clients, to the strategy.
+	for i := 0; i < lb.Count; i++ {
+		if lb.Backends[i] == first {
+			lb.SetHealthy(i, false)
+		}
+	}
+	moved, again := serve(cookie)
+	if moved == first || again == nil {
+		t.Errorf("Expected the client moved off %s with a new cookie, got %s %v", first, moved, again)
+	}
+}
+
+func TestPeakEWMAStrategy(t *testing.T) {
+	var slowHits, fastHits int64
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&slowHits, 1)
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&fastHits, 1)
+	}))
+	defer fast.Close()
+
+	lb, _ := NewLoadBalancer("peak-ewma")
+	lb.AddBackendTargetRule(slow.URL, 1, NewProxyTargetRule(sdk.Backend{Backend: slow.URL}, 0))
+	lb.AddBackendTargetRule(fast.URL, 1, NewProxyTargetRule(sdk.Backend{Backend: fast.URL}, 0))
+
+	// Connect to both first, so dialing does not make the fast one look slow.
+	for i := 0; i < lb.Count; i++ {
+		(*lb.Next[i]).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	}
+	atomic.StoreInt64(&slowHits, 0)
+	atomic.StoreInt64(&fastHits, 0)
+
+	for i := 0; i < 50; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	}
+	if slowHits*4 > fastHits {
+		t.Errorf("Expected load shifted to the fast backend, got slow %d, fast %d", slowHits, fastHits)
+	}
+
+	// Unhealthy backends are not sampled, however low their latency.
+	lb.SetHealthy(1, false)
+	for i := 0; i < 20; i++ {
+		if picked := lb.Strategy.Select(lb, httptest.NewRequest("GET", "http://localhost/", nil)); picked != 0 {
+			t.Fatalf("Expected the healthy backend, got %d", picked)
+		}
+	}
+
+	// A peak is taken at once, and forgiven over time.
+	var e peakEWMA
+	e.observe(float64(10*time.Millisecond), 10*time.Millisecond)
+	e.observe(float64(100*time.Millisecond), 10*time.Millisecond)
+	if v := e.get(10 * time.Millisecond); v < float64(50*time.Millisecond) {
+		t.Errorf("Expected the peak to be taken at once, got %v", time.Duration(v))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if v := e.get(10 * time.Millisecond); v > float64(5*time.Millisecond) {
+		t.Errorf("Expected the peak to decay, got %v", time.Duration(v))
+	}
+}
+
+// countingStrategy picks the first backend, counting the hooks called.
+type countingStrategy struct {
+	sync.Mutex
+	added, removed, started, finished int
+	latency                           time.Duration
+}
+
+func (c *countingStrategy) Select(lb *LoadBalancer, req *http.Request) int { return 0 }
+func (c *countingStrategy) BackendAdded(lb *LoadBalancer, backend int) {
+	c.Lock()
+	defer c.Unlock()
+	c.added++
+}
+func (c *countingStrategy) BackendRemoved(lb *LoadBalancer, backend int) {
+	c.Lock()
+	defer c.Unlock()
+	c.removed++
+}
+func (c *countingStrategy) RequestStarted(lb *LoadBalancer, backend int, req *http.Request) {
+	c.Lock()
+	defer c.Unlock()
+	c.started++
+}
+func (c *countingStrategy) RequestFinished(lb *LoadBalancer, backend int, req *http.Request, outcome *ProxyOutcome, latency time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.finished++
+	c.latency = latency
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	strategy := &countingStrategy{}
+	var built []string
+	RegisterStrategy("counting", func(Route Route) (Strategy, error) {
+		built = append(built, Route.HashKey)
+		return strategy, nil
+	})
+
+	route := Route{HashKey: "ip"}
+	route.Type, route.Path, route.Method = "proxytarget", "http://strategy.test/", "counting"
+	route.Backends = []sdk.Backend{{Backend: backend.URL}, {Backend: "http://unused:8080"}}
+
+	rootList := NewRouteTable()
+	if err := LoadConfiguration(nil, []Route{route}, rootList); err != nil {
+		t.Fatalf("Expected the registered strategy to load, got %s", err)
+	}
+	if len(built) != 1 || built[0] != "ip" {
+		t.Errorf("Expected the strategy built once, from the route, got %q", built)
+	}
+
+	req := httptest.NewRequest("GET", "http://strategy.test/", nil)
+	req.URL.Scheme = "http"
+	rs, err := rootList.Find(req)
+	if err != nil {
+		t.Fatalf("Expected the route, got %s", err)
+	}
+	rs.ServeHTTP(httptest.NewRecorder(), req)
+
+	strategy.Lock()
+	if strategy.added != 2 || strategy.started != 1 || strategy.finished != 1 || strategy.latency <= 0 {
+		t.Errorf("Expected hooks for 2 backends and 1 request with latency, got %+v", strategy)
+	}
+	strategy.Unlock()
+
+	// Reloading removes the backends, and unknown methods are rejected.
+	route.Method = "fastest-ever"
+	if err := LoadConfiguration(nil, []Route{route}, NewRouteTable()); err == nil {
+		t.Errorf("Expected an unknown method to be rejected")
+	}
+	if _, err := NewLoadBalancer("fastest-ever"); err == nil {
+		t.Errorf("Expected an unknown method to be rejected, by NewLoadBalancer")
+	}
+	route.Method = "round-robin"
+	if err := LoadConfiguration(nil, []Route{route}, NewRouteTable()); err != nil {
+		t.Errorf("Expected the configuration to reload, got %s", err)
+	}
+	strategy.Lock()
+	if strategy.removed != 2 {
+		t.Errorf("Expected the backends removed on reload, got %d", strategy.removed)
+	}
+	strategy.Unlock()
+}
+
+func TestHealthChecker(t *testing.T) {
+	var failing int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/base/health" {
+			res.WriteHeader(http.StatusNotFound)
+		} else if atomic.LoadInt32(&failing) == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer flaky.Close()
+
+	route := Route{Healthcheck: &HealthcheckConfig{Rise: 2, Fall: 2}}
+	route.HealthcheckPath, route.HealthcheckStatus, route.HealthcheckInterval = "/health", 200, 1
+
+	lb, _ := NewLoadBalancer("round-robin")
+	lb.AddBackendTargetRule(flaky.URL+"/base", 1, NewContentTargetRule("flaky"))
+	lb.AddBackendTargetRule("http://other:8080", 1, NewContentTargetRule("other"))
+
+	checker, err := NewHealthChecker(nil, route, lb, 0)
+	if err != nil {
+		t.Fatalf("Expected a checker, got %s", err)
+	}
+
+	checker.Check()
+	atomic.StoreInt32(&failing, 1)
+	checker.Check()
+	if !lb.Healthy(0) {
+		t.Errorf("Expected the backend healthy, until Fall probes failed")
+	}
+	checker.Check()
+	if lb.Healthy(0) {
+		t.Fatalf("Expected the backend unhealthy, after Fall probes failed")
+	}
+
+	for i := 0; i < 10; i++ {
+		atomic.AddInt64(&lb.Requests, 1)
+		if candidate := SelectStrategy(lb, nil); candidate != 1 {
+			t.Errorf("Expected the unhealthy backend skipped, got %d", candidate)
+		}
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	checker.Check()
+	if lb.Healthy(0) {
+		t.Errorf("Expected the backend unhealthy, until Rise probes succeeded")
+	}
+	checker.Check()
+	if !lb.Healthy(0) {
+		t.Errorf("Expected the backend healthy, after Rise probes succeeded")
+	}
+
+	// Healthcheckers are stopped, like timers, when reloading, but not by
+	// a reload that fails.
+	checker.Start()
+	timers.Insert(checker)
+	invalid := Route{}
+	invalid.Type, invalid.Path, invalid.Method = "proxytarget", "http://invalid.test/", "fastest-ever"
+	if err := LoadConfiguration(nil, []Route{invalid}, NewRouteTable()); err == nil {
+		t.Errorf("Expected an unknown method to fail the reload")
+	}
+	select {
+	case <-checker.stop:
+		t.Errorf("Expected the checker running, after a failed reload")
+	default:
+	}
+	if err := LoadConfiguration(nil, nil, NewRouteTable()); err != nil {
+		t.Errorf("Expected an empty configuration to load, got %s", err)
+	}
+	select {
+	case <-checker.stop:
+	default:
+		t.Errorf("Expected the checker stopped")
+	}
+
+	// A backend down stays down across reloads, until its probes succeed.
+	checked := Route{}
+	checked.Type, checked.Path, checked.Method = "proxytarget", "http://checked.test/", "round-robin"
+	checked.Backends = []sdk.Backend{{Backend: flaky.URL}}
+	checked.HealthcheckActive, checked.HealthcheckInterval = 1, 60
+	for reload := 0; reload < 2; reload++ {
+		if err := LoadConfiguration(nil, []Route{checked}, NewRouteTable()); err != nil {
+			t.Fatalf("Expected configuration to load, got %s", err)
+		}
+		balancers.Lock()
+		lb := balancers.m[routeKey(checked)][0]
+		balancers.Unlock()
+		if reload == 0 {
+			lb.SetHealthy(0, false)
+		} else if lb.Probed(0) {
+			t.Errorf("Expected the backend down, after the reload")
+		}
+	}
+	LoadConfiguration(nil, nil, NewRouteTable())
+}
+
+func TestProbes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "HEAD" && req.Header.Get("X-Probe") == "yes" {
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+		res.WriteHeader(http.StatusAccepted)
+		res.Write([]byte("status: up, version 3"))
+	}))
+	defer backend.Close()
+
+	probe := func(config HealthcheckConfig, backend string) error {
+		route := Route{Healthcheck: &config}
+		route.HealthcheckPath = "/health"
+		p, err := NewProbe(route, backend)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return p.Probe(ctx)
+	}
+
+	tests := []struct {
+		config  HealthcheckConfig
+		healthy bool
+	}{
+		{HealthcheckConfig{Status: []string{"2xx"}, Body: "up"}, true},
+		{HealthcheckConfig{Status: []string{"200-201"}}, false},
+		{HealthcheckConfig{Status: []string{"202"}, BodyMatch: "version [0-9]+$"}, true},
+		{HealthcheckConfig{Status: []string{"202"}, Body: "down"}, false},
+		{HealthcheckConfig{Status: []string{"204"}, Headers: []string{"X-Probe: yes"}}, true},
+		{HealthcheckConfig{Status: []string{"204"}, Method: "HEAD", Headers: []string{"X-Probe: yes"}}, false},
+		{HealthcheckConfig{Type: "tcp"}, true},
+	}
+	for _, test := range tests {
+		if err := probe(test.config, backend.URL); (err == nil) != test.healthy {
+			t.Errorf("Expected %+v healthy %v, got %v", test.config, test.healthy, err)
+		}
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	if err := probe(HealthcheckConfig{Type: "tcp"}, closed.URL); err == nil {
+		t.Errorf("Expected tcp probe of a closed port to fail")
+	}
+	if _, err := NewProbe(Route{Healthcheck: &HealthcheckConfig{Status: []string{"2x"}}}, backend.URL); err == nil {
+		t.Errorf("Expected an invalid status to be rejected")
+	}
+
+	// https probes have their own TLS settings.
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer secure.Close()
+	plain := strings.Replace(secure.URL, "https://", "http://", 1)
+	if err := probe(HealthcheckConfig{Type: "https", TLS: &ProbeTLSConfig{InsecureSkipVerify: true}}, plain); err != nil {
+		t.Errorf("Expected https probe to succeed, got %s", err)
+	}
+	if err := probe(HealthcheckConfig{Type: "https"}, plain); err == nil {
+		t.Errorf("Expected https probe to verify the certificate")
+	}
+
+	// gRPC health, over HTTP/2 on TLS, which any Go version probes.
+	grpc := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		res.Header().Set("Content-Type", "application/grpc")
+		if req.ProtoMajor != 2 || req.URL.Path != "/grpc.health.v1.Health/Check" {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// HealthCheckRequest{service: "payments"} answers NOT_SERVING.
+		status := byte(1)
+		if bytes.Contains(body, []byte("payments")) {
+			status = 2
+		}
+		if bytes.Contains(body, []byte("missing")) {
+			res.Header().Set("Grpc-Status", "5")
+			return
+		}
+		res.Header().Set("Trailer", "Grpc-Status")
+		res.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		res.Header().Set("Grpc-Status", "0")
+	}))
+	grpc.EnableHTTP2 = true
+	grpc.StartTLS()
+	defer grpc.Close()
+
+	insecure := &ProbeTLSConfig{InsecureSkipVerify: true}
+	for service, healthy := range map[string]bool{"": true, "payments": false, "missing": false} {
+		if err := probe(HealthcheckConfig{Type: "grpc", Service: service, TLS: insecure}, grpc.URL); (err == nil) != healthy {
+			t.Errorf("Expected grpc service %q healthy %v, got %v", service, healthy, err)
+		}
+	}
+}
+
+func TestOutlierDetector(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	route := Route{Outlier: &OutlierConfig{ConsecutiveErrors: 3, BaseEjection: 100, MaxEjection: 1000}}
+	lb, err := newLoadBalancerFromRoute(nil, route)
+	if err != nil {
+		t.Fatalf("Expected a load balancer, got %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		lb.AddBackendTargetRule(fmt.Sprintf("backend-%d", i), 1, NewProxyTargetRule(sdk.Backend{Backend: failing.URL}, 0))
+	}
+
+	fail := func(backend int, times int) {
+		for i := 0; i < times; i++ {
+			lb.serveBackend(backend, httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+		}
+	}
+
+	fail(0, 2)
+	if !lb.Healthy(0) {
+		t.Errorf("Expected the backend in, before ConsecutiveErrors")
+	}
+	fail(0, 1)
+	if lb.Healthy(0) || !lb.Probed(0) {
+		t.Fatalf("Expected the backend ejected, after ConsecutiveErrors")
+	}
+	for i := 0; i < 8; i++ {
+		atomic.AddInt64(&lb.Requests, 1)
+		if candidate := SelectStrategy(lb, nil); candidate == 0 {
+			t.Errorf("Expected the ejected backend skipped")
+		}
+	}
+
+	// At most half of the backends are ejected.
+	fail(1, 3)
+	fail(2, 3)
+	if lb.Healthy(1) || !lb.Healthy(2) {
+		t.Errorf("Expected two backends ejected, and no more")
+	}
+
+	// The back-off doubles, on the next ejection.
+	time.Sleep(150 * time.Millisecond)
+	if !lb.Healthy(0) {
+		t.Fatalf("Expected the backend returned, after BaseEjection")
+	}
+	fail(0, 3)
+	time.Sleep(150 * time.Millisecond)
+	if lb.Healthy(0) {
+		t.Errorf("Expected the second ejection to last longer")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !lb.Healthy(0) {
+		t.Errorf("Expected the backend returned, after twice BaseEjection")
+	}
+
+	// An error rate ejects too, without consecutive errors.
+	o := NewOutlierDetector(nil, OutlierConfig{ConsecutiveErrors: 100, ErrorRate: 0.5, MinRequests: 10})
+	rated, _ := NewLoadBalancer("round-robin")
+	for i := 0; i < 2; i++ {
+		rated.AddBackendTargetRule(fmt.Sprintf("backend-%d", i), 1, NewContentTargetRule(""))
+	}
+	for i := 0; i < 10; i++ {
+		status := http.StatusOK
+		if i%2 == 1 {
+			status = http.StatusBadGateway
+		}
+		o.Observe(rated, 0, &ProxyOutcome{StatusCode: status, At: time.Now()})
+	}
+	if rated.Healthy(0) {
+		t.Errorf("Expected the backend ejected, at ErrorRate")
+	}
+
+	// Replacing the balancer stops the ejection, of the one replaced, and
+	// hands it on to the balancer replacing it.
+	rated.Outlier = o
+	registerBalancers(map[string][]*LoadBalancer{"http://outlier.test/": {rated}})
+	reloaded, _ := NewLoadBalancer("round-robin")
+	reloaded.Outlier = NewOutlierDetector(nil, OutlierConfig{})
+	for i := 0; i < 2; i++ {
+		reloaded.AddBackendTargetRule(fmt.Sprintf("backend-%d", i), 1, NewContentTargetRule(""))
+	}
+	registerBalancers(map[string][]*LoadBalancer{"http://outlier.test/": {reloaded}})
+	o.Lock()
+	if o.backends[0].ejection != nil {
+		t.Errorf("Expected the ejection stopped, with the balancer replaced")
+	}
+	o.Unlock()
+	if reloaded.Healthy(0) || !reloaded.Healthy(1) {
+		t.Errorf("Expected the ejection handed on, to the balancer reloaded")
+	}
+	registerBalancers(map[string][]*LoadBalancer{})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	route := Route{Breaker: &BreakerConfig{Failures: 3, OpenDuration: 100, HalfOpenRequests: 2}}
+	proxy := newProxyTargetRuleFromRoute(nil, route, sdk.Backend{Backend: backend.URL})
+
+	serve := func() *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		proxy.ServeHTTP(res, httptest.NewRequest("GET", "http://localhost/", nil))
+		return res
+	}
+
+	for i := 0; i < 3; i++ {
+		serve()
+	}
+	if state := proxy.breaker.State(); state != BreakerOpen {
+		t.Fatalf("Expected the breaker open, after 3 failures, got %s", state)
+	}
+
+	// While open, requests fail fast, without reaching the backend.
+	res := serve()
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") != "1" || atomic.LoadInt64(&hits) != 3 {
+		t.Errorf("Expected fail fast with 503 and Retry-After, got %d %q after %d hits", res.Code, res.Header().Get("Retry-After"), hits)
+	}
+
+	// A failing trial opens it again.
+	time.Sleep(150 * time.Millisecond)
+	serve()
+	if state := proxy.breaker.State(); state != BreakerOpen {
+		t.Errorf("Expected a failed trial to open the breaker, got %s", state)
+	}
+
+	// Successful trials close it.
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(150 * time.Millisecond)
+	serve()
+	if state := proxy.breaker.State(); state != BreakerHalfOpen {
+		t.Errorf("Expected the breaker half-open, during trials, got %s", state)
+	}
+	serve()
+	if state := proxy.breaker.State(); state != BreakerClosed {
+		t.Errorf("Expected the breaker closed, after the trials, got %s", state)
+	}
+
+	var found bool
+	for _, stats := range AllBreakerStats() {
+		if stats.Backend == backend.URL {
+			found = true
+			if stats.Opened != 2 || stats.HalfOpened != 2 || stats.Closed != 1 || stats.Rejected != 1 {
+				t.Errorf("Expected the transitions counted, got %+v", stats)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected breaker stats for %s", backend.URL)
+	}
+
+	// Only the trials count, while half-open.
+	tickets := breakerFor(nil, "http://tickets:8080", BreakerSettings{Failures: 1, OpenDuration: 10 * time.Millisecond, HalfOpenRequests: 1})
+	first, _, _ := tickets.Allow()
+	late, _, _ := tickets.Allow()
+	tickets.Done(first, breakerFailure)
+	time.Sleep(20 * time.Millisecond)
+	trial, allowed, _ := tickets.Allow()
+	if !allowed || tickets.State() != BreakerHalfOpen {
+		t.Fatalf("Expected a trial, half-open, got %s", tickets.State())
+	}
+	tickets.Done(late, breakerSuccess)
+	tickets.Done(late, breakerIgnored)
+	if _, allowed, _ := tickets.Allow(); allowed || tickets.State() != BreakerHalfOpen {
+		t.Errorf("Expected a request allowed before, not to count as a trial, got %s", tickets.State())
+	}
+	tickets.Done(trial, breakerSuccess)
+	if state := tickets.State(); state != BreakerClosed {
+		t.Errorf("Expected the trial to close the breaker, got %s", state)
+	}
+
+	// A streamed trial is reported with its headers, not once it ends.
+	streaming := make(chan struct{})
+	stream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.WriteHeader(http.StatusOK)
+		res.(http.Flusher).Flush()
+		<-streaming
+	}))
+	defer stream.Close()
+	streamed := newProxyTargetRuleFromRoute(nil, Route{Breaker: &BreakerConfig{Failures: 1, OpenDuration: 10}},
+		sdk.Backend{Backend: stream.URL})
+	ticket, _, _ := streamed.breaker.Allow()
+	streamed.breaker.Done(ticket, breakerFailure)
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamed.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	}()
+	for i := 0; i < 100 && streamed.breaker.State() != BreakerClosed; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if state := streamed.breaker.State(); state != BreakerClosed {
+		t.Errorf("Expected the breaker closed, while the trial streams, got %s", state)
+	}
+	close(streaming)
+	<-done
+
+	// An open circuit fails over to another backend, when retrying.
+	open := breakerFor(nil, "http://open:8080", NewBreakerSettings(&BreakerConfig{Failures: 1, OpenDuration: 60000}, nil))
+	ticket, _, _ = open.Allow()
+	open.Done(ticket, breakerFailure)
+
+	retried, _ := newLoadBalancerFromRoute(nil, Route{Retry: &RetryConfig{}})
+	openRoute := Route{Breaker: &BreakerConfig{Failures: 1, OpenDuration: 60000}}
+	retried.AddTargetRule(newProxyTargetRuleFromRoute(nil, openRoute, sdk.Backend{Backend: "http://open:8080"}))
+	retried.AddTargetRule(newProxyTargetRuleFromRoute(nil, Route{}, sdk.Backend{Backend: backend.URL}))
+	for i := 0; i < 4; i++ {
+		res := httptest.NewRecorder()
+		retried.ServeHTTP(res, httptest.NewRequest("GET", "http://localhost/", nil))
+		if res.Code != http.StatusOK {
+			t.Errorf("Expected the open circuit failed over, got %d", res.Code)
+		}
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	newBalancer := func(backends ...string) (*LoadBalancer, map[string]*int64) {
+		route := Route{SlowStart: &SlowStartConfig{Window: 300, MinPercent: 10}}
+		route.Method = "least-connections"
+		lb, err := newLoadBalancerFromRoute(nil, route)
+		if err != nil {
+			t.Fatalf("Expected a balancer, got %s", err)
+		}
+		hits := make(map[string]*int64)
+		for _, backend := range backends {
+			count := new(int64)
+			hits[backend] = count
+			lb.AddBackendTargetRule(backend, 1, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				atomic.AddInt64(count, 1)
+			}))
+		}
+		return lb, hits
+	}
+	serve := func(lb *LoadBalancer, n int) {
+		for i := 0; i < n; i++ {
+			lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+		}
+	}
+
+	// Backends of a new route start at once.
+	old, _ := newBalancer("http://a:8080", "http://b:8080")
+	registerBalancers(map[string][]*LoadBalancer{"http://slowstart.test/": {old}})
+	if old.Warmth(0) != 1 || old.Warmth(1) != 1 {
+		t.Errorf("Expected backends of a new route at full weight, got %f %f", old.Warmth(0), old.Warmth(1))
+	}
+
+	// A backend joining on a reload ramps up, even with least-connections.
+	lb, hits := newBalancer("http://a:8080", "http://b:8080", "http://c:8080")
+	registerBalancers(map[string][]*LoadBalancer{"http://slowstart.test/": {lb}})
+	if lb.Warmth(0) != 1 || lb.Warmth(2) >= 0.5 {
+		t.Errorf("Expected only the joining backend ramping, got %f %f", lb.Warmth(0), lb.Warmth(2))
+	}
+	serve(lb, 900)
+	if joined := atomic.LoadInt64(hits["http://c:8080"]); joined > 200 {
+		t.Errorf("Expected the joining backend to get a small share, got %d of 900", joined)
+	}
+
+	time.Sleep(350 * time.Millisecond)
+	if lb.Warmth(2) != 1 {
+		t.Errorf("Expected full weight after the window, got %f", lb.Warmth(2))
+	}
+
+	// Recovering from healthchecks ramps up again, with any strategy.
+	lb.SetHealthy(1, false)
+	lb.SetHealthy(1, true)
+	if warmth := lb.Warmth(1); warmth >= 0.5 {
+		t.Errorf("Expected a recovered backend ramping, got %f", warmth)
+	}
+	lb.SetHealthy(0, true)
+	if warmth := lb.Warmth(0); warmth != 1 {
+		t.Errorf("Expected a healthy backend untouched, got %f", warmth)
+	}
+
+	// Requests turned away spread over the others, not onto the next one.
+	warm := &SlowStart{Window: time.Minute, MinPercent: 1}
+	spread, _ := NewLoadBalancer("round-robin")
+	spread.SlowStart = warm
+	for i := 0; i < 4; i++ {
+		spread.AddBackendTargetRule(fmt.Sprintf("http://spread-%d:8080", i), 1, http.NotFoundHandler())
+	}
+	spread.SetHealthy(1, false)
+	spread.SetHealthy(1, true)
+	var picks [4]int
+	for i := 0; i < 900; i++ {
+		atomic.AddInt64(&spread.Requests, 1)
+		picks[SelectStrategy(spread, nil)]++
+	}
+	if picks[2] > picks[0]*3/2 || picks[2] > picks[3]*3/2 {
+		t.Errorf("Expected requests turned away spread evenly, got %v", picks)
+	}
+
+	// With consistent-hash, they follow the ring, as when the backend is down.
+	ring, _ := NewLoadBalancer("consistent-hash")
+	ring.SlowStart = warm
+	for i := 0; i < 4; i++ {
+		ring.AddBackendTargetRule(fmt.Sprintf("http://ring-%d:8080", i), 1, http.NotFoundHandler())
+	}
+	keyed := func(i int) *http.Request {
+		return httptest.NewRequest("GET", fmt.Sprintf("http://localhost/key-%d", i), nil)
+	}
+	warming := SelectStrategy(ring, keyed(0))
+	ring.SetHealthy(warming, false)
+	var down [100]int
+	for i := range down {
+		down[i] = SelectStrategy(ring, keyed(i))
+	}
+	ring.SetHealthy(warming, true)
+	for i := range down {
+		if pick := SelectStrategy(ring, keyed(i)); pick != warming && pick != down[i] {
+			t.Errorf("Key %d, expected %d in ring order, got %d", i, down[i], pick)
+		}
+	}
+
+	// Without a slow start, nothing ramps.
+	plain, _ := NewLoadBalancer("round-robin")
+	plain.AddTargetRule(http.NotFoundHandler())
+	plain.SetHealthy(0, false)
+	plain.SetHealthy(0, true)
+	if plain.Warmth(0) != 1 {
+		t.Errorf("Expected no ramp, without a slow start, got %f", plain.Warmth(0))
+	}
+	registerBalancers(map[string][]*LoadBalancer{})
+}
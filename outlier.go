@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sdk "github.com/newsworthy39/golang-clouddom-sdk"
+)
+
+// OutlierDetector ejects backends, by the outcome of live requests; after
+// ConsecutiveErrors in a row, or when ErrorRate of at least MinRequests
+// within Window fail. A backend is ejected for BaseEjection, doubling on
+// repeated ejections up to MaxEjection. No more than MaxEjectedPercent of
+// the backends are ejected at a time.
+type OutlierDetector struct {
+	sync.Mutex
+	ConsecutiveErrors int
+	ErrorRate         float64
+	MinRequests       int
+	Window            time.Duration
+	BaseEjection      time.Duration
+	MaxEjection       time.Duration
+	MaxEjectedPercent int
+	apiConfig         *sdk.APIContext
+	backends          [64]outlierState
+}
+
+// outlierState is the recent history, of a backend.
+type outlierState struct {
+	consecutive int
+	windowStart time.Time
+	requests    int
+	errors      int
+	ejections   int
+	returned    time.Time
+	ejection    *time.Timer
+	until       time.Time
+}
+
+// NewOutlierDetector builds a detector, with the defaults of OutlierConfig.
+func NewOutlierDetector(apiConfig *sdk.APIContext, config OutlierConfig) *OutlierDetector {
+	o := &OutlierDetector{ConsecutiveErrors: config.ConsecutiveErrors,
+		ErrorRate:         config.ErrorRate,
+		MinRequests:       config.MinRequests,
+		Window:            time.Duration(config.Window) * time.Millisecond,
+		BaseEjection:      time.Duration(config.BaseEjection) * time.Millisecond,
+		MaxEjection:       time.Duration(config.MaxEjection) * time.Millisecond,
+		MaxEjectedPercent: config.MaxEjectedPercent,
+		apiConfig:         apiConfig}
+
+	if o.ConsecutiveErrors <= 0 {
+		o.ConsecutiveErrors = 5
+	}
+	if o.MinRequests <= 0 {
+		o.MinRequests = 20
+	}
+	if o.Window <= 0 {
+		o.Window = 10 * time.Second
+	}
+	if o.BaseEjection <= 0 {
+		o.BaseEjection = 30 * time.Second
+	}
+	if o.MaxEjection <= 0 {
+		o.MaxEjection = 5 * time.Minute
+	}
+	if o.MaxEjection < o.BaseEjection {
+		o.MaxEjection = o.BaseEjection
+	}
+	if o.MaxEjectedPercent <= 0 {
+		o.MaxEjectedPercent = 50
+	}
+	return o
+}
+
+// outlierFailure reports if an outcome counts against the backend, and if
+// it counts at all. Requests rejected by our own queue or circuit breaker,
+// and tunnels, do not count either way.
+func outlierFailure(outcome *ProxyOutcome) (bool, bool) {
+	switch {
+	case outcome.At.IsZero(), outcome.Reason == reasonOverloaded, outcome.Reason == reasonCircuitOpen:
+		return false, false
+	case outcome.Reason != "", outcome.StatusCode >= 500:
+		return true, true
+	}
+	return false, true
+}
+
+// Observe records the outcome of a request to the backend, ejecting it
+// when it turns out an outlier.
+func (o *OutlierDetector) Observe(lb *LoadBalancer, backend int, outcome *ProxyOutcome) {
+	failure, counts := outlierFailure(outcome)
+	if !counts {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	// Ejected backends may still finish requests, started before.
+	if atomic.LoadInt32(&lb.ejected[backend]) == 1 {
+		return
+	}
+
+	state := &o.backends[backend]
+	now := time.Now()
+	if now.Sub(state.windowStart) > o.Window {
+		state.windowStart, state.requests, state.errors = now, 0, 0
+	}
+	state.requests++
+	if !failure {
+		state.consecutive = 0
+		return
+	}
+	state.errors++
+	state.consecutive++
+
+	var reason string
+	switch {
+	case state.consecutive >= o.ConsecutiveErrors:
+		reason = fmt.Sprintf("%d consecutive errors", state.consecutive)
+	case o.ErrorRate > 0 && state.requests >= o.MinRequests &&
+		float64(state.errors)/float64(state.requests) >= o.ErrorRate:
+		reason = fmt.Sprintf("%d of %d requests failed", state.errors, state.requests)
+	default:
+		return
+	}
+	o.eject(lb, backend, reason)
+}
+
+// eject takes the backend out, unless too many are out already. Called
+// with the lock held.
+func (o *OutlierDetector) eject(lb *LoadBalancer, backend int, reason string) {
+	ejected := 0
+	for i := 0; i < lb.Count; i++ {
+		ejected += int(atomic.LoadInt32(&lb.ejected[i]))
+	}
+	if (ejected+1)*100 > lb.Count*o.MaxEjectedPercent {
+		log.Printf("Backend %s is an outlier, %s, but %d of %d backends are ejected already\n",
+			lb.backendName(backend), reason, ejected, lb.Count)
+		return
+	}
+
+	// Back-off grows with every ejection, and is forgotten after a while.
+	state := &o.backends[backend]
+	if !state.returned.IsZero() && time.Since(state.returned) > o.MaxEjection {
+		state.ejections = 0
+	}
+	duration := o.BaseEjection << uint(state.ejections)
+	if duration > o.MaxEjection || duration <= 0 {
+		duration = o.MaxEjection
+	}
+	state.ejections++
+	state.consecutive, state.requests, state.errors = 0, 0, 0
+
+	atomic.StoreInt32(&lb.ejected[backend], 1)
+	log.Printf("Backend %s ejected for %s, %s\n", lb.backendName(backend), duration, reason)
+	sendEvent(o.apiConfig, 1002, fmt.Sprintf("BackendEjected %s: %s", lb.backendName(backend), reason))
+	o.returnAfter(lb, backend, duration)
+}
+
+// returnAfter returns the ejected backend, after the duration. Called with
+// the lock held.
+func (o *OutlierDetector) returnAfter(lb *LoadBalancer, backend int, duration time.Duration) {
+	var ejection *time.Timer
+	ejection = time.AfterFunc(duration, func() {
+		o.Lock()
+		defer o.Unlock()
+		if o.backends[backend].ejection != ejection {
+			return
+		}
+		o.backends[backend].ejection = nil
+		o.backends[backend].returned = time.Now()
+		o.backends[backend].windowStart = time.Time{}
+		lb.startSlowly(backend)
+		atomic.StoreInt32(&lb.ejected[backend], 0)
+		log.Printf("Backend %s returned, after ejection\n", lb.backendName(backend))
+		sendEvent(o.apiConfig, 1003, fmt.Sprintf("BackendReturned %s", lb.backendName(backend)))
+	})
+	o.backends[backend].ejection = ejection
+	o.backends[backend].until = time.Now().Add(duration)
+}
+
+// BackendRemoved stops the ejection of a backend, taken out with its
+// LoadBalancer, so it is not returned to a balancer no longer in use.
+func (o *OutlierDetector) BackendRemoved(lb *LoadBalancer, backend int) {
+	o.Lock()
+	defer o.Unlock()
+
+	if ejection := o.backends[backend].ejection; ejection != nil {
+		ejection.Stop()
+		o.backends[backend].ejection = nil
+	}
+}
+
+// inherit carries an ejection over, from the detector of a balancer the
+// configuration replaces, for the time it has left.
+func (o *OutlierDetector) inherit(lb *LoadBalancer, backend int, from *OutlierDetector, old int) {
+	from.Lock()
+	state := from.backends[old]
+	from.Unlock()
+	if state.ejection == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	o.backends[backend].ejections = state.ejections
+	o.backends[backend].returned = state.returned
+	atomic.StoreInt32(&lb.ejected[backend], 1)
+	o.returnAfter(lb, backend, time.Until(state.until))
+}
+
+// inheritEjections carries the ejections of backends over, by name, from
+// the balancers of a route the configuration replaces.
+func inheritEjections(replaced map[string][]*LoadBalancer, m map[string][]*LoadBalancer) {
+	for route, lbs := range m {
+		for _, lb := range lbs {
+			if lb.Outlier == nil {
+				continue
+			}
+			for i := 0; i < lb.Count; i++ {
+				for _, previous := range replaced[route] {
+					for j := 0; j < previous.Count; j++ {
+						if previous.Outlier != nil && previous.Backends[j] == lb.Backends[i] {
+							lb.Outlier.inherit(lb, i, previous.Outlier, j)
+						}
+					}
+				}
+			}
+		}
+	}
+}
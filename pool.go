@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// backendPool is the connection-pool of a backend. It is shared by every
+// ProxyTargetRule, using the same backend and settings, and survives
+// configuration reloads using it too, keeping connections warm.
+type backendPool struct {
+	Backend  string
+	Limits   PoolLimits
+	client   *http.Client
+	open     int64
+	active   int64
+	requests int64
+}
+
+// PoolLimits of a backendPool. Zero MaxConnections means unlimited.
+type PoolLimits struct {
+	MaxConnections     int
+	MaxIdleConnections int
+	IdleTimeout        time.Duration
+	KeepAlive          time.Duration
+}
+
+// PoolStats is a snapshot of a backendPool, for monitoring.
+type PoolStats struct {
+	Backend            string
+	OpenConnections    int64
+	ActiveRequests     int64
+	TotalRequests      int64
+	MaxConnections     int
+	MaxIdleConnections int
+}
+
+// pools are shared by backend and settings. Dropped pools close their idle
+// connections.
+var pools = newRegistry(func(pool *backendPool) {
+	pool.client.CloseIdleConnections()
+})
+
+// NewPoolLimits returns the limits of the route, each overridden by the
+// backend when set, defaulting as PoolConfig describes.
+func NewPoolLimits(route *PoolConfig, backend *PoolConfig) PoolLimits {
+	limits := PoolLimits{MaxIdleConnections: 32,
+		IdleTimeout: 30 * time.Second,
+		KeepAlive:   30 * time.Second}
+
+	for _, config := range []*PoolConfig{route, backend} {
+		if config == nil {
+			continue
+		}
+		if config.MaxConnections > 0 {
+			limits.MaxConnections = config.MaxConnections
+		}
+		if config.MaxIdleConnections > 0 {
+			limits.MaxIdleConnections = config.MaxIdleConnections
+		}
+		if config.IdleTimeout > 0 {
+			limits.IdleTimeout = time.Duration(config.IdleTimeout) * time.Millisecond
+		}
+		if config.KeepAlive > 0 {
+			limits.KeepAlive = time.Duration(config.KeepAlive) * time.Millisecond
+		}
+	}
+	return limits
+}
+
+// poolFor returns the pool of the backend, creating it on first use.
+func poolFor(backend string, timeouts Timeouts, limits PoolLimits) *backendPool {
+	key := fmt.Sprintf("%s %+v %+v", backend, timeouts, limits)
+	return pools.get(key, func() *backendPool {
+		return newBackendPool(backend, timeouts, limits)
+	})
+}
+
+func newBackendPool(backend string, timeouts Timeouts, limits PoolLimits) *backendPool {
+	pool := &backendPool{Backend: backend, Limits: limits}
+	dialer := &net.Dialer{Timeout: timeouts.Connect, KeepAlive: limits.KeepAlive}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&pool.open, 1)
+			return &pooledConn{Conn: conn, open: &pool.open}, nil
+		},
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		MaxConnsPerHost:       limits.MaxConnections,
+		MaxIdleConns:          limits.MaxIdleConnections,
+		MaxIdleConnsPerHost:   limits.MaxIdleConnections,
+		IdleConnTimeout:       limits.IdleTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	// Setup client, to *not* follow redirects, thanks to this hack.
+	pool.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return pool
+}
+
+// Do sends the request, through the pool.
+func (p *backendPool) Do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&p.requests, 1)
+	return p.client.Do(req)
+}
+
+func (p *backendPool) Stats() PoolStats {
+	return PoolStats{Backend: p.Backend,
+		OpenConnections:    atomic.LoadInt64(&p.open),
+		ActiveRequests:     atomic.LoadInt64(&p.active),
+		TotalRequests:      atomic.LoadInt64(&p.requests),
+		MaxConnections:     p.Limits.MaxConnections,
+		MaxIdleConnections: p.Limits.MaxIdleConnections}
+}
+
+// AllPoolStats returns the stats of every pool, ordered by backend.
+func AllPoolStats() []PoolStats {
+	stats := make([]PoolStats, 0)
+	for _, pool := range pools.values() {
+		stats = append(stats, pool.Stats())
+	}
+	return stats
+}
+
+// StatsHandler serves the pool and circuit breaker stats, as JSON.
+func StatsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(struct {
+		Pools    []PoolStats
+		Breakers []BreakerStats
+	}{AllPoolStats(), AllBreakerStats()})
+}
+
+// pooledConn keeps the count of open connections, of its pool.
+type pooledConn struct {
+	net.Conn
+	open   *int64
+	closed int32
+}
+
+func (c *pooledConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(c.open, -1)
+	}
+	return c.Conn.Close()
+}
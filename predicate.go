@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RequestPredicate evaluates a request, used by PropositionTargetRule
+// to choose a branch.
+type RequestPredicate func(req *http.Request) bool
+
+// valueMatcher matches a present value, either any, exact or by regular expression.
+func valueMatcher(Value string, Match string) (func(string) bool, error) {
+	if Match != "" {
+		pattern, err := regexp.Compile(Match)
+		if err != nil {
+			return nil, err
+		}
+		return func(v string) bool { return pattern.MatchString(v) }, nil
+	}
+	if Value != "" {
+		return func(v string) bool { return v == Value }, nil
+	}
+	return func(v string) bool { return true }, nil
+}
+
+// HeaderPredicate is true, when the header is present, equals Value
+// or matches the regular expression Match.
+func HeaderPredicate(Name string, Value string, Match string) (RequestPredicate, error) {
+	matcher, err := valueMatcher(Value, Match)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request) bool {
+		values, prs := req.Header[http.CanonicalHeaderKey(Name)]
+		if !prs {
+			return false
+		}
+		for _, v := range values {
+			if matcher(v) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// QueryPredicate is true, when the query-parameter is present, equals
+// Value or matches the regular expression Match.
+func QueryPredicate(Name string, Value string, Match string) (RequestPredicate, error) {
+	matcher, err := valueMatcher(Value, Match)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request) bool {
+		values, prs := req.URL.Query()[Name]
+		if !prs {
+			return false
+		}
+		for _, v := range values {
+			if matcher(v) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// CookiePredicate is true, when the cookie is present, equals Value
+// or matches the regular expression Match.
+func CookiePredicate(Name string, Value string, Match string) (RequestPredicate, error) {
+	matcher, err := valueMatcher(Value, Match)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request) bool {
+		cookie, err := req.Cookie(Name)
+		if err != nil {
+			return false
+		}
+		return matcher(cookie.Value)
+	}, nil
+}
+
+// MethodPredicate is true, when the request uses one of the methods.
+func MethodPredicate(Methods ...string) RequestPredicate {
+	return func(req *http.Request) bool {
+		for _, method := range Methods {
+			if strings.EqualFold(req.Method, method) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// CIDRPredicate is true, when the client-address is within one of the networks.
+func CIDRPredicate(CIDRs ...string) (RequestPredicate, error) {
+	var networks []*net.IPNet
+	for _, cidr := range CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return func(req *http.Request) bool {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// TimePredicate is true, when the local time of day is within From and
+// To, formatted as 15:04. Windows may wrap midnight, as 22:00-06:00.
+func TimePredicate(From string, To string) (RequestPredicate, error) {
+	from, err := time.Parse("15:04", From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse("15:04", To)
+	if err != nil {
+		return nil, err
+	}
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+
+	return func(req *http.Request) bool {
+		now := time.Now()
+		minute := now.Hour()*60 + now.Minute()
+		if start <= end {
+			return minute >= start && minute < end
+		}
+		return minute >= start || minute < end
+	}, nil
+}
+
+// AndPredicate is true, when all predicates are.
+func AndPredicate(Predicates ...RequestPredicate) RequestPredicate {
+	return func(req *http.Request) bool {
+		for _, predicate := range Predicates {
+			if !predicate(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// OrPredicate is true, when any of the predicates are.
+func OrPredicate(Predicates ...RequestPredicate) RequestPredicate {
+	return func(req *http.Request) bool {
+		for _, predicate := range Predicates {
+			if predicate(req) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NotPredicate negates the predicate.
+func NotPredicate(Predicate RequestPredicate) RequestPredicate {
+	return func(req *http.Request) bool {
+		return !Predicate(req)
+	}
+}
+
+// NewPredicate builds a predicate from its configuration.
+func NewPredicate(config PredicateConfig) (RequestPredicate, error) {
+	var children []RequestPredicate
+	for _, child := range config.Predicates {
+		predicate, err := NewPredicate(child)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, predicate)
+	}
+
+	switch strings.ToLower(config.Type) {
+	case "header":
+		return HeaderPredicate(config.Name, config.Value, config.Match)
+	case "query":
+		return QueryPredicate(config.Name, config.Value, config.Match)
+	case "cookie":
+		return CookiePredicate(config.Name, config.Value, config.Match)
+	case "method":
+		return MethodPredicate(config.Values...), nil
+	case "cidr":
+		return CIDRPredicate(config.Values...)
+	case "time":
+		return TimePredicate(config.From, config.To)
+	case "and":
+		return AndPredicate(children...), nil
+	case "or":
+		return OrPredicate(children...), nil
+	case "not":
+		if len(children) != 1 {
+			return nil, fmt.Errorf("Predicate not, takes exactly one predicate, got %d", len(children))
+		}
+		return NotPredicate(children[0]), nil
+	}
+	return nil, fmt.Errorf("Unknown predicate type %s", config.Type)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Probe checks the health of a backend, once. The context carries the
+// timeout of the probe.
+type Probe interface {
+	Probe(ctx context.Context) error
+}
+
+// statusRange is an inclusive range of status codes.
+type statusRange struct {
+	From int
+	To   int
+}
+
+// parseStatusRanges parses status codes as 200, 200-299 or 2xx.
+func parseStatusRanges(statuses []string) ([]statusRange, error) {
+	var ranges []statusRange
+	for _, status := range statuses {
+		var r statusRange
+		var class int
+		switch {
+		case len(status) == 3 && strings.HasSuffix(strings.ToLower(status), "xx"):
+			if _, err := fmt.Sscanf(status[:1], "%d", &class); err != nil {
+				return nil, fmt.Errorf("Invalid status %s", status)
+			}
+			r = statusRange{class * 100, class*100 + 99}
+		case strings.Contains(status, "-"):
+			if _, err := fmt.Sscanf(status, "%d-%d", &r.From, &r.To); err != nil {
+				return nil, fmt.Errorf("Invalid status range %s", status)
+			}
+		default:
+			if _, err := fmt.Sscanf(status, "%d", &r.From); err != nil {
+				return nil, fmt.Errorf("Invalid status %s", status)
+			}
+			r.To = r.From
+		}
+		if r.From < 100 || r.To > 599 || r.From > r.To {
+			return nil, fmt.Errorf("Invalid status %s", status)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// HTTPProbe sends a request, expecting a status in one of the ranges, and
+// the body to contain Body and match BodyMatch, when set.
+type HTTPProbe struct {
+	URL       string
+	Method    string
+	Header    http.Header
+	Status    []statusRange
+	Body      string
+	BodyMatch *regexp.Regexp
+	client    *http.Client
+}
+
+func (p *HTTPProbe) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, p.Method, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range p.Header {
+		req.Header[name] = values
+	}
+	if host := p.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+
+	matched := false
+	for _, r := range p.Status {
+		if resp.StatusCode >= r.From && resp.StatusCode <= r.To {
+			matched = true
+		}
+	}
+	switch {
+	case !matched:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	case p.Body != "" && !bytes.Contains(body, []byte(p.Body)):
+		return fmt.Errorf("body does not contain %q", p.Body)
+	case p.BodyMatch != nil && !p.BodyMatch.Match(body):
+		return fmt.Errorf("body does not match %s", p.BodyMatch)
+	}
+	return nil
+}
+
+// TCPProbe connects to Address, and hangs up.
+type TCPProbe struct {
+	Address string
+}
+
+func (p *TCPProbe) Probe(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// GRPCProbe calls grpc.health.v1.Health/Check for Service (empty for the
+// server as a whole), expecting SERVING. The protocol is small enough, to
+// encode by hand; a length-prefixed protobuf message over HTTP/2.
+type GRPCProbe struct {
+	URL     string
+	Service string
+	client  *http.Client
+}
+
+// grpcServing is the SERVING status, of a HealthCheckResponse.
+const grpcServing = 1
+
+func (p *GRPCProbe) Probe(ctx context.Context) error {
+	// HealthCheckRequest{service = 1}, as a gRPC message.
+	message := append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(p.Service)))...)
+	message = append(message, p.Service...)
+	frame := append([]byte{0}, binary.BigEndian.AppendUint32(nil, uint32(len(message)))...)
+	frame = append(frame, message...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	// Errors come as trailers, or in the headers, without a body.
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		return fmt.Errorf("grpc-status %s %s", status, message)
+	}
+
+	serving, err := grpcHealthStatus(body)
+	if err != nil {
+		return err
+	}
+	if serving != grpcServing {
+		return fmt.Errorf("grpc health status %d, expected SERVING", serving)
+	}
+	return nil
+}
+
+// grpcHealthStatus decodes the status of a HealthCheckResponse message.
+func grpcHealthStatus(body []byte) (uint64, error) {
+	if len(body) < 5 || body[0] != 0 {
+		return 0, errors.New("invalid grpc response")
+	}
+	length := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < length {
+		return 0, errors.New("truncated grpc response")
+	}
+	message := body[5 : 5+length]
+
+	// Skip fields, until status = 1 (varint). It is 0, UNKNOWN, when absent.
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("invalid grpc message")
+		}
+		message = message[n:]
+
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0, errors.New("invalid grpc message")
+			}
+			message = message[n:]
+			if key>>3 == 1 {
+				return value, nil
+			}
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return 0, errors.New("invalid grpc message")
+			}
+			message = message[n+int(length):]
+		default:
+			return 0, fmt.Errorf("unexpected wire type %d", key&7)
+		}
+	}
+	return 0, nil
+}
+
+// newProbeTLSConfig builds the TLS settings of probes.
+func newProbeTLSConfig(config *ProbeTLSConfig) (*tls.Config, error) {
+	if config == nil {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify}
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %s", config.CAFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// NewProbe builds the probe of a backend, from the healthcheck of the
+// route. The probe goes to the host of the backend, on the path of the
+// backend joined with HealthcheckPath.
+func NewProbe(Route Route, backend string) (Probe, error) {
+	var config HealthcheckConfig
+	if Route.Healthcheck != nil {
+		config = *Route.Healthcheck
+	}
+
+	target, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := url.Parse(Route.HealthcheckPath)
+	if err != nil {
+		return nil, err
+	}
+	target.Path = singleJoiningSlash(target.Path, probe.Path)
+	target.RawPath = ""
+	target.RawQuery = probe.RawQuery
+
+	tlsConfig, err := newProbeTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	// Probes should not follow redirects, nor keep connections around.
+	transport := &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}
+	client := &http.Client{Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+
+	switch strings.ToLower(config.Type) {
+	case "", "http", "https":
+		if strings.ToLower(config.Type) == "https" {
+			target.Scheme = "https"
+		}
+
+		statuses := config.Status
+		if len(statuses) == 0 {
+			statuses = []string{"200"}
+			if Route.HealthcheckStatus != 0 {
+				statuses = []string{fmt.Sprintf("%d", Route.HealthcheckStatus)}
+			}
+		}
+		ranges, err := parseStatusRanges(statuses)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &HTTPProbe{URL: target.String(),
+			Method: config.Method,
+			Header: make(http.Header),
+			Status: ranges,
+			Body:   config.Body,
+			client: client}
+		if p.Method == "" {
+			p.Method = http.MethodGet
+		}
+		for _, header := range config.Headers {
+			s := strings.SplitN(header, ":", 2)
+			if len(s) != 2 {
+				return nil, fmt.Errorf("Invalid header %s", header)
+			}
+			p.Header.Add(strings.TrimSpace(s[0]), strings.TrimSpace(s[1]))
+		}
+		if config.BodyMatch != "" {
+			if p.BodyMatch, err = regexp.Compile(config.BodyMatch); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+
+	case "tcp":
+		port := target.Port()
+		if port == "" {
+			port = "80"
+			if target.Scheme == "https" {
+				port = "443"
+			}
+		}
+		return &TCPProbe{Address: net.JoinHostPort(target.Hostname(), port)}, nil
+
+	case "grpc":
+		// gRPC runs on HTTP/2, see grpcTransport.
+		if err := grpcTransport(transport, target); err != nil {
+			return nil, err
+		}
+
+		target.Path = "/grpc.health.v1.Health/Check"
+		target.RawQuery = ""
+		return &GRPCProbe{URL: target.String(), Service: config.Service, client: client}, nil
+	}
+	return nil, fmt.Errorf("Unknown healthcheck type %s", config.Type)
+}
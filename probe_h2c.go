@@ -0,0 +1,17 @@
+//go:build go1.24
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// grpcTransport runs the transport of a gRPC probe on HTTP/2, also
+// without TLS, to http-backends.
+func grpcTransport(transport *http.Transport, target *url.URL) error {
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return nil
+}
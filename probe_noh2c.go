@@ -0,0 +1,20 @@
+//go:build !go1.24
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// grpcTransport runs the transport of a gRPC probe on HTTP/2. Before Go
+// 1.24, the standard library has HTTP/2 over TLS only, so http-backends
+// can not be probed.
+func grpcTransport(transport *http.Transport, target *url.URL) error {
+	if target.Scheme != "https" {
+		return fmt.Errorf("gRPC healthchecks of http-backends need Go 1.24, %s", target.Host)
+	}
+	transport.ForceAttemptHTTP2 = true
+	return nil
+}
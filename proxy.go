@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// backendURL composes the backend-url, from the target and the request.
+// The path of the target is joined with the request-path, keeping its
+// escaping, and query-strings are merged. When stripPrefix is set, the
+// prefix matched by the RouteExpression is removed first.
+func backendURL(target *url.URL, req *http.Request, stripPrefix bool) *url.URL {
+	path, rawPath := req.URL.Path, req.URL.RawPath
+	if stripPrefix {
+		if match, ok := RouteMatchFromRequest(req); ok {
+			path, rawPath = stripURLPath(path, req.URL.EscapedPath(), match.Prefix)
+		}
+	}
+
+	u := *target
+	u.Path, u.RawPath = joinURLPath(target, path, rawPath)
+	switch {
+	case target.RawQuery == "":
+		u.RawQuery = req.URL.RawQuery
+	case req.URL.RawQuery == "":
+		u.RawQuery = target.RawQuery
+	default:
+		u.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
+	u.Fragment = ""
+	return &u
+}
+
+// stripURLPath removes prefix from path, and the same prefix from the
+// escaped path, returning the path and its raw form, if any.
+func stripURLPath(path string, escaped string, prefix string) (string, string) {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return path, ""
+	}
+	stripped := path[len(prefix):]
+
+	// Find the suffix of the escaped path, that unescapes to the stripped path.
+	var raw string
+	for i := len(escaped) - len(stripped); i >= 0; i-- {
+		if unescaped, err := url.PathUnescape(escaped[i:]); err == nil && unescaped == stripped {
+			raw = escaped[i:]
+			break
+		}
+	}
+
+	if !strings.HasPrefix(stripped, "/") {
+		stripped = "/" + stripped
+		if raw != "" {
+			raw = "/" + raw
+		}
+	}
+
+	// Only keep the raw path, when it differs from the default escaping.
+	if raw == (&url.URL{Path: stripped}).EscapedPath() {
+		raw = ""
+	}
+	return stripped, raw
+}
+
+// joinURLPath joins the target path with the request path, using a single
+// slash between them.
+func joinURLPath(target *url.URL, path string, rawPath string) (string, string) {
+	if rawPath == "" && target.RawPath == "" {
+		return singleJoiningSlash(target.Path, path), ""
+	}
+
+	escaped := rawPath
+	if escaped == "" {
+		escaped = (&url.URL{Path: path}).EscapedPath()
+	}
+	return singleJoiningSlash(target.Path, path), singleJoiningSlash(target.EscapedPath(), escaped)
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && b != "":
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// Hop-by-hop headers, removed when proxying (RFC 7230, 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including the ones
+// listed in the Connection-header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// filterHeaders keeps the allowed headers only, if any is given, and
+// removes the denied ones.
+func filterHeaders(h http.Header, allow []string, deny []string) {
+	if len(allow) > 0 {
+		allowed := make(map[string]bool)
+		for _, name := range allow {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		for name := range h {
+			if !allowed[http.CanonicalHeaderKey(name)] {
+				delete(h, name)
+			}
+		}
+	}
+	for _, name := range deny {
+		h.Del(name)
+	}
+}
+
+// forwardedFor appends the client-address, to X-Forwarded-For.
+func forwardedFor(req *http.Request) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if prior, prs := req.Header["X-Forwarded-For"]; prs {
+		return strings.Join(prior, ", ") + ", " + client
+	}
+	return client
+}
+
+// copyResponse streams the body to the client, in bounded memory. With a
+// negative flushInterval, every write is flushed, with a positive, writes
+// are flushed at most flushInterval later.
+func copyResponse(dst http.ResponseWriter, src io.Reader, flushInterval time.Duration) (int64, error) {
+	var w io.Writer = dst
+	if flushInterval != 0 {
+		if flusher, ok := dst.(http.Flusher); ok {
+			latency := &maxLatencyWriter{dst: dst, flusher: flusher, latency: flushInterval}
+			defer latency.stop()
+			w = latency
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	return io.CopyBuffer(w, src, buf)
+}
+
+// maxLatencyWriter flushes writes, within latency.
+type maxLatencyWriter struct {
+	sync.Mutex
+	dst     io.Writer
+	flusher http.Flusher
+	latency time.Duration
+	timer   *time.Timer
+	pending bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	n, err := m.dst.Write(p)
+	if m.latency < 0 {
+		m.flusher.Flush()
+		return n, err
+	}
+
+	if m.pending {
+		return n, err
+	}
+	if m.timer == nil {
+		m.timer = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.timer.Reset(m.latency)
+	}
+	m.pending = true
+	return n, err
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.Lock()
+	defer m.Unlock()
+
+	// stop may have run, before we got the lock.
+	if !m.pending {
+		return
+	}
+	m.flusher.Flush()
+	m.pending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.pending = false
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
+
+// upgradeType returns the protocol requested in Upgrade, when Connection
+// asks for an upgrade.
+func upgradeType(h http.Header) string {
+	for _, value := range h["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// tunnelUpgrade hijacks the client-connection, after the backend switched
+// protocols, and copies bytes both ways until either side closes.
+func tunnelUpgrade(res http.ResponseWriter, upgrade string, resp *http.Response) error {
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return errors.New("backend connection is not writable")
+	}
+	defer backConn.Close()
+
+	hijacker, ok := res.(http.Hijacker)
+	if !ok {
+		return errors.New("ResponseWriter does not support hijacking")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", upgrade)
+	resp.Body = nil
+	if err := resp.Write(brw); err != nil {
+		return err
+	}
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+
+	// When one direction ends, close both, so the other ends too.
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			conn.Close()
+			backConn.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		io.Copy(backConn, brw)
+	}()
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		io.Copy(conn, backConn)
+	}()
+	wg.Wait()
+
+	return nil
+}
+
+// countingConn counts the bytes read and written, atomically.
+type countingConn struct {
+	net.Conn
+	read    *int64
+	written *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+// Timeouts towards a backend. Zero means no timeout.
+type Timeouts struct {
+	Connect        time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	Total          time.Duration
+}
+
+// NewTimeouts applies the backend override, on top of the route timeouts.
+func NewTimeouts(route *TimeoutConfig, backend *TimeoutConfig) Timeouts {
+	var timeouts Timeouts
+	for _, config := range []*TimeoutConfig{route, backend} {
+		if config == nil {
+			continue
+		}
+		if config.Connect > 0 {
+			timeouts.Connect = time.Duration(config.Connect) * time.Millisecond
+		}
+		if config.TLSHandshake > 0 {
+			timeouts.TLSHandshake = time.Duration(config.TLSHandshake) * time.Millisecond
+		}
+		if config.ResponseHeader > 0 {
+			timeouts.ResponseHeader = time.Duration(config.ResponseHeader) * time.Millisecond
+		}
+		if config.Total > 0 {
+			timeouts.Total = time.Duration(config.Total) * time.Millisecond
+		}
+	}
+	return timeouts
+}
+
+// Reasons a backend call failed, as logged and sent with the BackendFailed
+// event.
+const (
+	reasonTimeout           = "timeout"
+	reasonTimeoutConnect    = "timeout=connect"
+	reasonTimeoutTLS        = "timeout=tls"
+	reasonTimeoutHeader     = "timeout=header"
+	reasonTimeoutTotal      = "timeout=total"
+	reasonDNS               = "dns"
+	reasonConnectionRefused = "connection refused"
+	reasonConnectionReset   = "connection reset"
+	reasonTLS               = "tls"
+	reasonBadGateway        = "bad gateway"
+	reasonInvalidRequest    = "invalid request"
+	reasonProtocolSwitch    = "protocol switch"
+)
+
+// isTimeout reports if the reason is any of the timeouts.
+func isTimeout(reason string) bool {
+	return strings.HasPrefix(reason, reasonTimeout)
+}
+
+// classifyBackendError maps an error calling a backend, to the status
+// returned to the client, and a short reason for the logs.
+func classifyBackendError(err error) (int, string) {
+	var (
+		dnsError         *net.DNSError
+		netError         net.Error
+		recordError      tls.RecordHeaderError
+		certError        *tls.CertificateVerificationError
+		unknownAuthority x509.UnknownAuthorityError
+		hostnameError    x509.HostnameError
+	)
+
+	var opError *net.OpError
+	switch {
+	case errors.As(err, &opError) && opError.Op == "dial" && opError.Timeout():
+		return http.StatusGatewayTimeout, reasonTimeoutConnect
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		return http.StatusGatewayTimeout, reasonTimeoutTLS
+	case strings.Contains(err.Error(), "timeout awaiting response headers"):
+		return http.StatusGatewayTimeout, reasonTimeoutHeader
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, reasonTimeout
+	case errors.As(err, &dnsError):
+		return http.StatusBadGateway, reasonDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusServiceUnavailable, reasonConnectionRefused
+	case errors.As(err, &recordError), errors.As(err, &certError),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameError):
+		return http.StatusBadGateway, reasonTLS
+	case errors.As(err, &netError) && netError.Timeout():
+		return http.StatusGatewayTimeout, reasonTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadGateway, reasonConnectionReset
+	}
+	return http.StatusBadGateway, reasonBadGateway
+}
+
+type outcomeKey struct{}
+
+// ProxyOutcome is filled in by ProxyTargetRule, when the request carries
+// one, so the LoadBalancer can tell how the backend call went, and when
+// the response (or failure) arrived.
+type ProxyOutcome struct {
+	StatusCode int
+	Reason     string
+	At         time.Time
+}
+
+// withOutcome returns the request, carrying a fresh outcome.
+func withOutcome(req *http.Request) (*http.Request, *ProxyOutcome) {
+	outcome := new(ProxyOutcome)
+	return req.WithContext(context.WithValue(req.Context(), outcomeKey{}, outcome)), outcome
+}
+
+// outcomeOf returns the request, carrying an outcome, reusing the one it
+// carries already.
+func outcomeOf(req *http.Request) (*http.Request, *ProxyOutcome) {
+	if outcome, ok := req.Context().Value(outcomeKey{}).(*ProxyOutcome); ok {
+		return req, outcome
+	}
+	return withOutcome(req)
+}
+
+func recordOutcome(req *http.Request, statusCode int, reason string) {
+	if outcome, ok := req.Context().Value(outcomeKey{}).(*ProxyOutcome); ok {
+		outcome.StatusCode = statusCode
+		outcome.Reason = reason
+		outcome.At = time.Now()
+	}
+}
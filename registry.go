@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// configGeneration counts the configurations loaded, so the registries can
+// tell which of their values the latest one uses.
+var configGeneration int64
+
+// registry shares a value per key, as the pool or breaker of a backend and
+// its settings, between every ProxyTargetRule using it, also across
+// reloads. Values are stamped with the configuration, using them last, and
+// dropped once a later configuration is loaded without them.
+type registry[V any] struct {
+	sync.Mutex
+	m       map[string]*registered[V]
+	dropped func(V)
+}
+
+type registered[V any] struct {
+	value      V
+	generation int64
+}
+
+// newRegistry returns an empty registry. Dropped, when not nil, releases
+// the resources of the values dropped.
+func newRegistry[V any](dropped func(V)) *registry[V] {
+	return &registry[V]{m: make(map[string]*registered[V]), dropped: dropped}
+}
+
+// get returns the value of the key, creating it on first use.
+func (r *registry[V]) get(key string, create func() V) V {
+	r.Lock()
+	defer r.Unlock()
+
+	entry, prs := r.m[key]
+	if !prs {
+		entry = &registered[V]{value: create()}
+		r.m[key] = entry
+	}
+	entry.generation = atomic.LoadInt64(&configGeneration)
+	return entry.value
+}
+
+// values returns the values, ordered by their key.
+func (r *registry[V]) values() []V {
+	r.Lock()
+	defer r.Unlock()
+
+	keys := make([]string, 0, len(r.m))
+	for key := range r.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]V, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, r.m[key].value)
+	}
+	return values
+}
+
+// sweep drops the values, not used since the configuration of generation.
+// Rules still holding one, keep using it until they are replaced.
+func (r *registry[V]) sweep(generation int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	for key, entry := range r.m {
+		if entry.generation < generation {
+			delete(r.m, key)
+			if r.dropped != nil {
+				r.dropped(entry.value)
+			}
+		}
+	}
+}
+
+// sweepRegistries drops the pools, limiters and breakers, the
+// configuration of generation does not use.
+func sweepRegistries(generation int64) {
+	pools.sweep(generation)
+	limiters.sweep(generation)
+	breakers.sweep(generation)
+}
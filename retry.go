@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides when the LoadBalancer retries a request, on another
+// backend. Retries are limited by a budget, so a failing pool doesn't see
+// its traffic multiplied.
+type RetryPolicy struct {
+	Attempts      int
+	RetryOn       []string
+	NonIdempotent bool
+	MaxBodyBytes  int64
+	budget        *retryBudget
+}
+
+// NewRetryPolicy builds a policy, with the defaults listed on RetryConfig.
+func NewRetryPolicy(config RetryConfig) (*RetryPolicy, error) {
+	policy := &RetryPolicy{Attempts: config.Attempts,
+		RetryOn:       config.RetryOn,
+		NonIdempotent: config.NonIdempotent,
+		MaxBodyBytes:  config.MaxBodyBytes,
+		budget:        newRetryBudget(config.BudgetRatio, config.BudgetMinPerSecond)}
+
+	if policy.Attempts <= 0 {
+		policy.Attempts = 2
+	}
+	if len(policy.RetryOn) == 0 {
+		policy.RetryOn = []string{"connect", "502", "503"}
+	}
+	if policy.MaxBodyBytes <= 0 {
+		policy.MaxBodyBytes = 64 * 1024
+	}
+
+	for _, on := range policy.RetryOn {
+		switch on {
+		case "connect", "timeout", "5xx":
+		default:
+			var code int
+			if _, err := fmt.Sscanf(on, "%d", &code); err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("Unknown retry condition %s", on)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Allows reports if the request may be retried at all.
+func (p *RetryPolicy) Allows(req *http.Request) bool {
+	if p.NonIdempotent {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Retryable reports if the outcome of an attempt, is worth retrying.
+func (p *RetryPolicy) Retryable(statusCode int, outcome *ProxyOutcome) bool {
+	for _, on := range p.RetryOn {
+		switch on {
+		case "connect":
+			switch outcome.Reason {
+			case reasonConnectionRefused, reasonDNS, reasonTimeoutConnect, reasonTLS, reasonOverloaded, reasonCircuitOpen:
+				return true
+			}
+		case "timeout":
+			if isTimeout(outcome.Reason) {
+				return true
+			}
+		case "5xx":
+			if statusCode >= 500 {
+				return true
+			}
+		default:
+			if on == fmt.Sprintf("%d", statusCode) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryBudget allows retries up to ratio of the requests, plus a minimum
+// per second, over a sliding window.
+type retryBudget struct {
+	sync.Mutex
+	ratio        float64
+	minPerSecond int
+	window       time.Duration
+	start        time.Time
+	requests     int
+	retries      int
+}
+
+func newRetryBudget(ratio float64, minPerSecond int) *retryBudget {
+	if ratio <= 0 {
+		ratio = 0.2
+	}
+	if minPerSecond <= 0 {
+		minPerSecond = 10
+	}
+	return &retryBudget{ratio: ratio, minPerSecond: minPerSecond,
+		window: 10 * time.Second, start: time.Now()}
+}
+
+func (b *retryBudget) roll() {
+	if time.Since(b.start) > b.window {
+		b.start = time.Now()
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+func (b *retryBudget) request() {
+	b.Lock()
+	defer b.Unlock()
+	b.roll()
+	b.requests++
+}
+
+// withdraw takes a retry from the budget, if there is one left.
+func (b *retryBudget) withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.roll()
+
+	allowed := float64(b.minPerSecond)*b.window.Seconds() + b.ratio*float64(b.requests)
+	if float64(b.retries+1) > allowed {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// serveWithRetries tries a different backend per attempt, until an attempt
+// is not retryable, attempts run out, or the budget does.
+func (l *LoadBalancer) serveWithRetries(res http.ResponseWriter, req *http.Request) {
+	l.Retry.budget.request()
+
+	// Buffer the body, so it can be replayed. Larger bodies aren't retried.
+	var body []byte
+	if req.Body != nil && req.ContentLength != 0 {
+		buffered, err := ioutil.ReadAll(io.LimitReader(req.Body, l.Retry.MaxBodyBytes+1))
+		if err != nil || int64(len(buffered)) > l.Retry.MaxBodyBytes {
+			req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buffered), req.Body))
+			candidate := SelectStrategy(l, req)
+			l.serveBackend(candidate, res, req)
+			return
+		}
+		body = buffered
+	}
+
+	tried := make([]bool, l.Count)
+	for attempt := 1; ; attempt++ {
+		candidate := l.selectUntried(req, tried)
+		tried[candidate] = true
+
+		attemptReq, outcome := withOutcome(req)
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		if attempt >= l.Retry.Attempts || !l.untried(tried) {
+			l.serveBackend(candidate, res, attemptReq)
+			return
+		}
+
+		writer := &retryResponseWriter{res: res, header: make(http.Header),
+			retryable: func(statusCode int) bool {
+				return l.Retry.Retryable(statusCode, outcome) && l.Retry.budget.withdraw()
+			}}
+		l.serveBackend(candidate, writer, attemptReq)
+		if !writer.discarded {
+			return
+		}
+
+		log.Printf("Retrying %s %s, attempt %d failed with %d %s\n",
+			req.Method, req.URL.Path, attempt, writer.statusCode, outcome.Reason)
+	}
+}
+
+// selectUntried uses the strategy, but moves on to the next healthy
+// backend not yet tried, or any not yet tried.
+func (l *LoadBalancer) selectUntried(req *http.Request, tried []bool) int {
+	candidate := SelectStrategy(l, req)
+	for _, healthy := range []bool{true, false} {
+		for i := 0; i < l.Count; i++ {
+			next := (candidate + i) % l.Count
+			if !tried[next] && (l.Healthy(next) || !healthy) {
+				return next
+			}
+		}
+	}
+	return candidate
+}
+
+func (l *LoadBalancer) untried(tried []bool) bool {
+	for _, t := range tried {
+		if !t {
+			return true
+		}
+	}
+	return false
+}
+
+// retryResponseWriter holds back the response, until the status is known.
+// Retryable responses are discarded, everything else is passed on, and
+// streamed as usual.
+type retryResponseWriter struct {
+	res        http.ResponseWriter
+	header     http.Header
+	retryable  func(statusCode int) bool
+	statusCode int
+	committed  bool
+	discarded  bool
+}
+
+func (w *retryResponseWriter) Header() http.Header {
+	if w.committed {
+		return w.res.Header()
+	}
+	return w.header
+}
+
+func (w *retryResponseWriter) WriteHeader(statusCode int) {
+	if w.committed || w.discarded {
+		return
+	}
+	w.statusCode = statusCode
+
+	if w.retryable(statusCode) {
+		w.discarded = true
+		return
+	}
+	w.commit()
+	w.res.WriteHeader(statusCode)
+}
+
+func (w *retryResponseWriter) commit() {
+	for name, values := range w.header {
+		w.res.Header()[name] = values
+	}
+	w.committed = true
+}
+
+func (w *retryResponseWriter) Write(b []byte) (int, error) {
+	if !w.committed && !w.discarded {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discarded {
+		return len(b), nil
+	}
+	return w.res.Write(b)
+}
+
+func (w *retryResponseWriter) Flush() {
+	if w.committed {
+		if flusher, ok := w.res.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// Hijack commits the response, as the connection is handed over.
+func (w *retryResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.res.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack: ResponseWriter does not support hijacking")
+	}
+	w.commit()
+	return hijacker.Hijack()
+}
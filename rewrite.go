@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type rewriteHostKey struct{}
+
+// RewriteTargetRule rewrites path and host of a request, before passing
+// it on. The path is rewritten in its escaped form; first StripPrefix is
+// removed, then Match is replaced by Replace, and last AddPrefix is added.
+type RewriteTargetRule struct {
+	StripPrefix  string
+	AddPrefix    string
+	Match        *regexp.Regexp
+	Replace      string
+	Host         string
+	PreserveHost bool
+	Next         *http.Handler
+}
+
+// NewRewriteTargetRule builds a rewrite from its configuration.
+func NewRewriteTargetRule(config RewriteConfig) (*RewriteTargetRule, error) {
+	rule := &RewriteTargetRule{StripPrefix: config.StripPrefix,
+		AddPrefix:    config.AddPrefix,
+		Replace:      config.Replace,
+		Host:         config.Host,
+		PreserveHost: config.PreserveHost}
+
+	if config.Match != "" {
+		match, err := regexp.Compile(config.Match)
+		if err != nil {
+			return nil, err
+		}
+		rule.Match = match
+	}
+	return rule, nil
+}
+
+func (r *RewriteTargetRule) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	path := r.rewritePath(req.URL.EscapedPath(), req)
+
+	ctx := req.Context()
+	switch {
+	case r.Host != "":
+		ctx = context.WithValue(ctx, rewriteHostKey{}, ExpandRouteParams(r.Host, req))
+	case r.PreserveHost:
+		ctx = context.WithValue(ctx, rewriteHostKey{}, req.Host)
+	}
+
+	rewritten := req.WithContext(ctx)
+	u := *req.URL
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		u.Path, u.RawPath = unescaped, path
+	}
+	rewritten.URL = &u
+
+	(*r.Next).ServeHTTP(res, rewritten)
+}
+
+func (r *RewriteTargetRule) rewritePath(path string, req *http.Request) string {
+	if r.StripPrefix != "" && strings.HasPrefix(path, r.StripPrefix) {
+		path = path[len(r.StripPrefix):]
+	}
+
+	if r.Match != nil {
+		path = r.Match.ReplaceAllString(path, ExpandRouteParams(r.Replace, req))
+	}
+
+	if r.AddPrefix != "" {
+		path = singleJoiningSlash(r.AddPrefix, path)
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+func (r *RewriteTargetRule) AddTargetRule(rule http.Handler) {
+	r.Next = &rule
+}
+
+// rewrittenHost returns the Host to send to the backend, if rewritten.
+func rewrittenHost(req *http.Request) (string, bool) {
+	host, ok := req.Context().Value(rewriteHostKey{}).(string)
+	return host, ok
+}
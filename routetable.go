@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/newsworthy39/golang-https-loadbalancer/util"
+)
+
+// RouteTable holds RouteExpressions, keyed by host and then by path.
+// Lookups always return the most specific matching route, regardless of
+// the order routes were inserted in. Hosts are matched exact first, then
+// by the longest wildcard-suffix (*.example.com) and last the catch-all (*).
+type RouteTable struct {
+	sync.RWMutex
+	exact    map[string]*hostRoutes
+	wildcard map[string]*hostRoutes
+	catchall *hostRoutes
+	fallback util.Trie
+	size     int
+}
+
+// hostRoutes holds the paths of a single host, per scheme. The empty
+// scheme matches any scheme.
+type hostRoutes struct {
+	schemes map[string]*util.Trie
+}
+
+// hostCandidate is host-routes matching a request. With portless set,
+// they matched only once the port of the request was dropped; routes from
+// scheme://host paths then do not apply, as that host has no such port.
+type hostCandidate struct {
+	routes   *hostRoutes
+	portless bool
+}
+
+// routeEntry holds the routes, sharing the same literal path-prefix. The
+// patterns are more specific than the literal, and are tried first.
+type routeEntry struct {
+	literal  *RouteExpression
+	patterns []*RouteExpression
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{exact: make(map[string]*hostRoutes),
+		wildcard: make(map[string]*hostRoutes)}
+}
+
+// Insert adds a route to the table. Routes declaring Hosts are matched
+// on host and path. Routes, that carry scheme://host in Path, are matched
+// as such. Their literal routes are kept in a prefix fallback too, using
+// the plain string-prefix semantics on scheme://host/path, for requests
+// no route matches on whole segments; so http://local still matches
+// http://localhost/, and http://host/ap matches /api.
+func (t *RouteTable) Insert(route *RouteExpression) error {
+	if err := route.Compile(); err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.exact == nil {
+		t.exact = make(map[string]*hostRoutes)
+		t.wildcard = make(map[string]*hostRoutes)
+	}
+	t.size++
+
+	if len(route.Hosts) > 0 {
+		for _, pattern := range route.Hosts {
+			host, scheme := splitHostPattern(pattern)
+			t.hostRoutesFor(host).insert(scheme, route)
+		}
+		return nil
+	}
+
+	scheme, host, _, ok := splitRoutePath(route.Path)
+	if route.pattern == nil {
+		t.fallback.Insert(route.Path, route)
+	}
+	if ok {
+		t.hostRoutesFor(host).insert(scheme, route)
+	}
+	return nil
+}
+
+// Find returns the most specific route, for the request.
+func (t *RouteTable) Find(req *http.Request) (*RouteExpression, error) {
+	t.RLock()
+	defer t.RUnlock()
+
+	host := NormalizeHost(req.Host, req.URL.Scheme)
+	for _, candidate := range t.candidates(host) {
+		if route := candidate.routes.find(req.URL.Scheme, req.URL.Path, candidate.portless); route != nil {
+			return route, nil
+		}
+	}
+
+	if _, route, err := t.fallback.LongestPrefix(fmt.Sprintf("%s://%s%s",
+		req.URL.Scheme, req.Host, req.URL.Path)); err == nil {
+		return route.(*RouteExpression), nil
+	}
+
+	return nil, errors.New("FindTargetGroupByRouteExpression: No routes found")
+}
+
+// Len returns the number of routes in the table.
+func (t *RouteTable) Len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return t.size
+}
+
+// hostRoutesFor returns the routes for a host-pattern, creating them.
+func (t *RouteTable) hostRoutesFor(pattern string) *hostRoutes {
+	pattern = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+
+	var (
+		routes *hostRoutes
+		prs    bool
+	)
+	switch {
+	case pattern == "*" || pattern == "":
+		if t.catchall == nil {
+			t.catchall = &hostRoutes{schemes: make(map[string]*util.Trie)}
+		}
+		return t.catchall
+	case strings.HasPrefix(pattern, "*."):
+		if routes, prs = t.wildcard[pattern[1:]]; !prs {
+			routes = &hostRoutes{schemes: make(map[string]*util.Trie)}
+			t.wildcard[pattern[1:]] = routes
+		}
+	default:
+		if routes, prs = t.exact[pattern]; !prs {
+			routes = &hostRoutes{schemes: make(map[string]*util.Trie)}
+			t.exact[pattern] = routes
+		}
+	}
+	return routes
+}
+
+// candidates returns the host-routes matching a normalized host, most
+// specific first. The host carries a port, only when it is not the
+// default of the scheme. Hosts-patterns with a port only match that port,
+// and those without one match any port. Hosts of scheme://host paths only
+// match the default port, unless they name another.
+func (t *RouteTable) candidates(host string) []hostCandidate {
+	var candidates []hostCandidate
+
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if routes, prs := t.exact[host]; prs {
+			candidates = append(candidates, hostCandidate{routes, false})
+		}
+		name = h
+		if strings.Contains(name, ":") {
+			name = "[" + name + "]"
+		}
+	}
+	portless := host != name
+	if routes, prs := t.exact[name]; prs {
+		candidates = append(candidates, hostCandidate{routes, portless})
+	}
+
+	// Wildcards, longest suffix first. *.example.com matches any
+	// subdomain of example.com, but not example.com itself.
+	for i := strings.Index(name, "."); i >= 0; {
+		if portless {
+			if routes, prs := t.wildcard[host[i:]]; prs {
+				candidates = append(candidates, hostCandidate{routes, false})
+			}
+		}
+		if routes, prs := t.wildcard[name[i:]]; prs {
+			candidates = append(candidates, hostCandidate{routes, portless})
+		}
+		next := strings.Index(name[i+1:], ".")
+		if next < 0 {
+			break
+		}
+		i = i + 1 + next
+	}
+
+	if t.catchall != nil {
+		candidates = append(candidates, hostCandidate{t.catchall, portless})
+	}
+	return candidates
+}
+
+// insert stores the route under its literal prefix.
+func (h *hostRoutes) insert(scheme string, route *RouteExpression) {
+	paths, prs := h.schemes[scheme]
+	if !prs {
+		paths = new(util.Trie)
+		h.schemes[scheme] = paths
+	}
+
+	var entry *routeEntry
+	if value, prs := paths.Get(route.prefix); prs {
+		entry = value.(*routeEntry)
+	} else {
+		entry = new(routeEntry)
+		paths.Insert(route.prefix, entry)
+	}
+
+	if route.pattern != nil {
+		entry.patterns = append(entry.patterns, route)
+	} else {
+		entry.literal = route
+	}
+}
+
+// find returns the route with the longest prefix matching, preferring the
+// scheme specific routes, over the ones accepting any scheme. Literal
+// prefixes match on path segments, so /api matches /api and /api/users,
+// but not /apiary; a prefix ending in / matches everything below. Portless
+// leaves out the scheme specific routes, of scheme://host paths.
+func (h *hostRoutes) find(scheme string, path string, portless bool) *RouteExpression {
+	type candidate struct {
+		length int
+		entry  *routeEntry
+	}
+	var candidates []candidate
+
+	schemes := []string{scheme, ""}
+	if portless {
+		schemes = schemes[1:]
+	}
+	for _, s := range schemes {
+		paths, prs := h.schemes[s]
+		if !prs {
+			continue
+		}
+		paths.WalkPrefixes(path, func(prefix string, value interface{}) bool {
+			candidates = append(candidates, candidate{len(prefix), value.(*routeEntry)})
+			return true
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].length > candidates[j].length
+	})
+
+	for _, c := range candidates {
+		for _, route := range c.entry.patterns {
+			if route.pattern.MatchString(path) {
+				return route
+			}
+		}
+		if c.entry.literal != nil && segmentPrefix(path, c.length) {
+			return c.entry.literal
+		}
+	}
+	return nil
+}
+
+// splitHostPattern drops a default port from a Hosts-pattern, returning
+// the scheme it implies, so example.com:443 matches example.com on https
+// only. Other patterns match any scheme.
+func splitHostPattern(pattern string) (string, string) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host, port, err := net.SplitHostPort(pattern)
+	switch {
+	case err == nil && port == "443":
+		return host, "https"
+	case err == nil && port == "80":
+		return host, "http"
+	}
+	return pattern, ""
+}
+
+// segmentPrefix reports if the prefix of path, of length n, ends on a path
+// segment.
+func segmentPrefix(path string, n int) bool {
+	return n == 0 || n == len(path) || path[n-1] == '/' || path[n] == '/'
+}
+
+// NormalizeHost lowercases a Host-header, strips a trailing dot and the
+// default port of the scheme, so example.com:443 equals example.com on https.
+func NormalizeHost(host string, scheme string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(host, ".")
+	}
+
+	name = strings.TrimSuffix(name, ".")
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") || port == "" {
+		if strings.Contains(name, ":") {
+			return "[" + name + "]"
+		}
+		return name
+	}
+	return net.JoinHostPort(name, port)
+}
+
+// splitRoutePath splits http://host/path into http, host and /path. A
+// regular expression path follows the host directly, as http://host~^/v[0-9]+/.
+func splitRoutePath(path string) (string, string, string, bool) {
+	i := strings.Index(path, "://")
+	if i < 0 {
+		return "", "", "", false
+	}
+	scheme, rest := strings.ToLower(path[:i]), path[i+3:]
+	slash := strings.IndexAny(rest, "/~")
+	if slash < 0 {
+		return scheme, NormalizeHost(rest, scheme), "", true
+	}
+	return scheme, NormalizeHost(rest[:slash], scheme), rest[slash:], true
+}
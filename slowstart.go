@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// SlowStart ramps up the traffic of a backend, joining the LoadBalancer on
+// a reload, recovering from its healthchecks or returning from ejection.
+// Its effective weight grows linearly, from MinPercent of its share to the
+// full share, over Window.
+type SlowStart struct {
+	Window     time.Duration
+	MinPercent int
+}
+
+// NewSlowStart builds the ramp; SlowStartConfig has its defaults.
+func NewSlowStart(config SlowStartConfig) *SlowStart {
+	s := &SlowStart{Window: time.Duration(config.Window) * time.Millisecond,
+		MinPercent: config.MinPercent}
+
+	if s.Window <= 0 {
+		s.Window = 30 * time.Second
+	}
+	if s.MinPercent <= 0 || s.MinPercent > 100 {
+		s.MinPercent = 10
+	}
+	return s
+}
+
+// startSlowly ramps the backend up, from now, when the LoadBalancer has a
+// slow start.
+func (l *LoadBalancer) startSlowly(backend int) {
+	if l.SlowStart != nil {
+		atomic.StoreInt64(&l.warming[backend], time.Now().UnixNano())
+	}
+}
+
+// Warmth returns the share of its traffic a backend gets, from
+// MinPercent/100 to 1, while ramping up, and 1 otherwise.
+func (l *LoadBalancer) Warmth(backend int) float64 {
+	started := atomic.LoadInt64(&l.warming[backend])
+	if started == 0 || l.SlowStart == nil {
+		return 1
+	}
+
+	elapsed := time.Since(time.Unix(0, started))
+	if elapsed >= l.SlowStart.Window {
+		atomic.CompareAndSwapInt64(&l.warming[backend], started, 0)
+		return 1
+	}
+	floor := float64(l.SlowStart.MinPercent) / 100
+	return floor + (1-floor)*float64(elapsed)/float64(l.SlowStart.Window)
+}
+
+// admits reports if a request, selected for the backend, may go there. A
+// ramping backend turns requests away, by its warmth.
+func (l *LoadBalancer) admits(backend int) bool {
+	warmth := l.Warmth(backend)
+	return warmth >= 1 || rand.Float64() < warmth
+}
+
+// reselect selects another backend, for a request the candidate turned
+// away, among the healthy backends admitting it; by the Strategy, when it
+// is an AcceptingStrategy, otherwise by weight. The candidate is kept,
+// when no other backend admits the request.
+func (l *LoadBalancer) reselect(req *http.Request, candidate int) int {
+	var admitted [64]bool
+	var others []int
+	var total int64
+	for i := 0; i < l.Count; i++ {
+		if i != candidate && l.Healthy(i) && l.admits(i) {
+			admitted[i] = true
+			others = append(others, i)
+			total += atomic.LoadInt64(&l.Weights[i])
+		}
+	}
+	if len(others) == 0 {
+		return candidate
+	}
+
+	accept := func(backend int) bool { return admitted[backend] }
+	if strategy, ok := l.Strategy.(AcceptingStrategy); ok {
+		if next, ok := strategy.SelectAccepted(l, req, accept); ok {
+			return next
+		}
+	}
+
+	// By weight, or as equals, when all of them are drained.
+	if total <= 0 {
+		return others[rand.Intn(len(others))]
+	}
+	pick := rand.Int63n(total)
+	for _, i := range others {
+		if pick -= atomic.LoadInt64(&l.Weights[i]); pick < 0 {
+			return i
+		}
+	}
+	return others[len(others)-1]
+}
+
+// startJoined ramps up the backends of the balancers, that are new to the
+// route of a configuration replaced. Routes new themselves start at once.
+func startJoined(replaced map[string][]*LoadBalancer, m map[string][]*LoadBalancer) {
+	for route, lbs := range m {
+		previous, prs := replaced[route]
+		if !prs {
+			continue
+		}
+
+		known := make(map[string]bool)
+		for _, lb := range previous {
+			for i := 0; i < lb.Count; i++ {
+				known[lb.Backends[i]] = true
+			}
+		}
+		for _, lb := range lbs {
+			for i := 0; i < lb.Count; i++ {
+				if !known[lb.Backends[i]] {
+					lb.startSlowly(i)
+				}
+			}
+		}
+	}
+}
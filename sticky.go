@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// stickySecret signs cookies of routes without a Secret. It changes on
+// restart, and differs between instances, breaking their sessions.
+var stickySecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// StickySessions pins clients to a backend, with a signed cookie naming
+// it. Clients are moved, when their backend is unhealthy.
+type StickySessions struct {
+	Cookie   string
+	TTL      time.Duration
+	Path     string
+	Domain   string
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+	secret   []byte
+}
+
+// NewStickySessions builds sticky sessions from their configuration.
+func NewStickySessions(config StickyConfig) (*StickySessions, error) {
+	sticky := &StickySessions{Cookie: config.Cookie,
+		TTL:      time.Duration(config.TTL) * time.Second,
+		Path:     config.Path,
+		Domain:   config.Domain,
+		Secure:   config.Secure,
+		HttpOnly: config.HttpOnly,
+		secret:   []byte(config.Secret)}
+
+	if sticky.Cookie == "" {
+		sticky.Cookie = "lb_backend"
+	}
+	if sticky.Path == "" {
+		sticky.Path = "/"
+	}
+	if len(sticky.secret) == 0 {
+		sticky.secret = stickySecret
+	}
+
+	switch strings.ToLower(config.SameSite) {
+	case "":
+	case "lax":
+		sticky.SameSite = http.SameSiteLaxMode
+	case "strict":
+		sticky.SameSite = http.SameSiteStrictMode
+	case "none":
+		sticky.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("Unknown SameSite %s", config.SameSite)
+	}
+	return sticky, nil
+}
+
+// value returns the signed cookie-value, of a backend. The backend is
+// identified by a hash of its name, so the cookie does not reveal it.
+func (s *StickySessions) value(lb *LoadBalancer, backend int) string {
+	id := stickyID(lb, backend)
+	return id + "." + s.sign(id)
+}
+
+func (s *StickySessions) sign(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func stickyID(lb *LoadBalancer, backend int) string {
+	return fmt.Sprintf("%016x", hashString(lb.backendName(backend)))
+}
+
+// Backend returns the backend of the request, if it carries a valid
+// cookie, naming a healthy backend.
+func (s *StickySessions) Backend(lb *LoadBalancer, req *http.Request) (int, bool) {
+	cookie, err := req.Cookie(s.Cookie)
+	if err != nil {
+		return 0, false
+	}
+	i := strings.IndexByte(cookie.Value, '.')
+	if i < 0 {
+		return 0, false
+	}
+	id, signature := cookie.Value[:i], cookie.Value[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.sign(id))) {
+		return 0, false
+	}
+
+	for backend := 0; backend < lb.Count; backend++ {
+		if stickyID(lb, backend) == id {
+			return backend, lb.Healthy(backend)
+		}
+	}
+	return 0, false
+}
+
+func (s *StickySessions) cookie(lb *LoadBalancer, backend int) *http.Cookie {
+	cookie := &http.Cookie{Name: s.Cookie,
+		Value:    s.value(lb, backend),
+		Path:     s.Path,
+		Domain:   s.Domain,
+		Secure:   s.Secure,
+		HttpOnly: s.HttpOnly,
+		SameSite: s.SameSite}
+	if s.TTL > 0 {
+		cookie.MaxAge = int(s.TTL / time.Second)
+		cookie.Expires = time.Now().Add(s.TTL)
+	}
+	return cookie
+}
+
+// backendName returns the name of a backend, or its position when unnamed.
+func (l *LoadBalancer) backendName(backend int) string {
+	if l.Backends[backend] != "" {
+		return l.Backends[backend]
+	}
+	return fmt.Sprintf("%d", backend)
+}
+
+// stickyResponseWriter sets the cookie, along with the response headers.
+type stickyResponseWriter struct {
+	http.ResponseWriter
+	cookie      *http.Cookie
+	wroteHeader bool
+}
+
+func (w *stickyResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		http.SetCookie(w.ResponseWriter, w.cookie)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *stickyResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *stickyResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *stickyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack: ResponseWriter does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
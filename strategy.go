@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategy selects the backend of a request, for a LoadBalancer. Each
+// LoadBalancer has its own Strategy, which may keep state, and is called
+// concurrently. The hooks let it follow the backends, and the requests.
+type Strategy interface {
+	// Select returns the position of the backend, for the request.
+	Select(lb *LoadBalancer, req *http.Request) int
+
+	// BackendAdded is called when a backend is added, and BackendRemoved
+	// when it is taken out, as when the configuration is reloaded.
+	BackendAdded(lb *LoadBalancer, backend int)
+	BackendRemoved(lb *LoadBalancer, backend int)
+
+	// RequestStarted is called, when a request is passed to the backend,
+	// and RequestFinished when it is done. Latency is the time to the
+	// response headers or the failure, and zero for tunnels.
+	RequestStarted(lb *LoadBalancer, backend int, req *http.Request)
+	RequestFinished(lb *LoadBalancer, backend int, req *http.Request, outcome *ProxyOutcome, latency time.Duration)
+}
+
+// AcceptingStrategy is a Strategy, that can select among some backends
+// only. When a backend, starting slowly, turns a request away, it selects
+// again among the others, rather than leaving it to the LoadBalancer.
+type AcceptingStrategy interface {
+	Strategy
+
+	// SelectAccepted returns the position of an accepted backend, for the
+	// request, and false when it has none.
+	SelectAccepted(lb *LoadBalancer, req *http.Request, accept func(backend int) bool) (int, bool)
+}
+
+// StrategyFactory builds a Strategy, for a LoadBalancer of the route.
+type StrategyFactory func(Route Route) (Strategy, error)
+
+// StrategyHooks implements the hooks of a Strategy, doing nothing. Embed
+// it, to implement the hooks needed only.
+type StrategyHooks struct{}
+
+func (StrategyHooks) BackendAdded(lb *LoadBalancer, backend int)                      {}
+func (StrategyHooks) BackendRemoved(lb *LoadBalancer, backend int)                    {}
+func (StrategyHooks) RequestStarted(lb *LoadBalancer, backend int, req *http.Request) {}
+func (StrategyHooks) RequestFinished(lb *LoadBalancer, backend int, req *http.Request, outcome *ProxyOutcome, latency time.Duration) {
+}
+
+// StrategyFunc is a Strategy without state, and hooks.
+type StrategyFunc func(lb *LoadBalancer, req *http.Request) int
+
+func (f StrategyFunc) Select(lb *LoadBalancer, req *http.Request) int {
+	return f(lb, req)
+}
+
+func (StrategyFunc) BackendAdded(lb *LoadBalancer, backend int)                      {}
+func (StrategyFunc) BackendRemoved(lb *LoadBalancer, backend int)                    {}
+func (StrategyFunc) RequestStarted(lb *LoadBalancer, backend int, req *http.Request) {}
+func (StrategyFunc) RequestFinished(lb *LoadBalancer, backend int, req *http.Request, outcome *ProxyOutcome, latency time.Duration) {
+}
+
+// stateless registers a StrategyFunc, as a factory.
+func stateless(f StrategyFunc) StrategyFactory {
+	return func(Route Route) (Strategy, error) {
+		return f, nil
+	}
+}
+
+var strategies = struct {
+	sync.RWMutex
+	m map[string]StrategyFactory
+}{m: map[string]StrategyFactory{
+	"round-robin":          stateless(RoundRobinStrategy),
+	"random":               stateless(RandomStrategy),
+	"least-connections":    stateless(LeastConnectionsStrategy),
+	"weighted-round-robin": newSmoothWeightedRoundRobin,
+	"consistent-hash":      newConsistentHash,
+	"peak-ewma":            newPeakEWMA,
+}}
+
+// RegisterStrategy makes a Strategy available, by name, as the Method of
+// routes. Registering a name again replaces the Strategy.
+func RegisterStrategy(name string, factory StrategyFactory) {
+	strategies.Lock()
+	defer strategies.Unlock()
+	strategies.m[strings.ToLower(name)] = factory
+}
+
+// NewStrategy builds the Strategy registered by name, for the route. An
+// empty name is round-robin.
+func NewStrategy(name string, Route Route) (Strategy, error) {
+	if name == "" {
+		name = "round-robin"
+	}
+
+	strategies.RLock()
+	factory, prs := strategies.m[strings.ToLower(name)]
+	strategies.RUnlock()
+
+	if !prs {
+		return nil, fmt.Errorf("Unknown method %s, one of %s", name, strings.Join(StrategyNames(), ", "))
+	}
+	return factory(Route)
+}
+
+// StrategyNames returns the names of the registered strategies, sorted.
+func StrategyNames() []string {
+	strategies.RLock()
+	defer strategies.RUnlock()
+
+	names := make([]string, 0, len(strategies.m))
+	for name := range strategies.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,155 @@
+package util
+
+import (
+	"errors"
+)
+
+// Trie is a compressed radix-tree, mapping string-keys to values. Lookups
+// cost the length of the key, not the number of keys stored, which makes
+// it suitable for route-tables with thousands of entries.
+type Trie struct {
+	root trieNode
+	size int
+}
+
+type trieNode struct {
+	prefix   string
+	children []*trieNode
+	value    interface{}
+	hasValue bool
+}
+
+// Insert stores value under key, replacing any previous value.
+func (t *Trie) Insert(key string, value interface{}) {
+	n := &t.root
+	for {
+		if len(key) == 0 {
+			if !n.hasValue {
+				t.size++
+			}
+			n.value = value
+			n.hasValue = true
+			return
+		}
+
+		child := n.child(key[0])
+		if child == nil {
+			n.children = append(n.children, &trieNode{prefix: key, value: value, hasValue: true})
+			t.size++
+			return
+		}
+
+		common := commonPrefix(key, child.prefix)
+		if common < len(child.prefix) {
+			// Split child, at the point where key and child diverge.
+			split := &trieNode{prefix: child.prefix[:common], children: []*trieNode{child}}
+			n.replace(split)
+			child.prefix = child.prefix[common:]
+			child = split
+		}
+
+		key = key[common:]
+		n = child
+	}
+}
+
+// Get returns the value stored exactly under key.
+func (t *Trie) Get(key string) (interface{}, bool) {
+	n := &t.root
+	for len(key) > 0 {
+		child := n.child(key[0])
+		if child == nil || len(key) < len(child.prefix) || key[:len(child.prefix)] != child.prefix {
+			return nil, false
+		}
+		key = key[len(child.prefix):]
+		n = child
+	}
+	return n.value, n.hasValue
+}
+
+// LongestPrefix returns the value, whose key is the longest prefix of key.
+func (t *Trie) LongestPrefix(key string) (string, interface{}, error) {
+	var (
+		matched string
+		value   interface{}
+		found   bool
+	)
+
+	t.WalkPrefixes(key, func(prefix string, v interface{}) bool {
+		matched, value, found = prefix, v, true
+		return true
+	})
+
+	if !found {
+		return "", nil, errors.New("LongestPrefix: No prefix found")
+	}
+	return matched, value, nil
+}
+
+// WalkPrefixes calls fn for every stored key, that is a prefix of key,
+// shortest first. Walking stops, when fn returns false.
+func (t *Trie) WalkPrefixes(key string, fn func(prefix string, value interface{}) bool) {
+	n := &t.root
+	consumed := 0
+	for {
+		if n.hasValue && !fn(key[:consumed], n.value) {
+			return
+		}
+		rest := key[consumed:]
+		if len(rest) == 0 {
+			return
+		}
+		child := n.child(rest[0])
+		if child == nil || len(rest) < len(child.prefix) || rest[:len(child.prefix)] != child.prefix {
+			return
+		}
+		consumed += len(child.prefix)
+		n = child
+	}
+}
+
+// Walk calls fn for every key in the trie, in no particular order.
+func (t *Trie) Walk(fn func(key string, value interface{})) {
+	var walk func(n *trieNode, key string)
+	walk = func(n *trieNode, key string) {
+		key = key + n.prefix
+		if n.hasValue {
+			fn(key, n.value)
+		}
+		for _, child := range n.children {
+			walk(child, key)
+		}
+	}
+	walk(&t.root, "")
+}
+
+// Len returns the number of keys stored.
+func (t *Trie) Len() int {
+	return t.size
+}
+
+func (n *trieNode) child(b byte) *trieNode {
+	for _, child := range n.children {
+		if child.prefix[0] == b {
+			return child
+		}
+	}
+	return nil
+}
+
+func (n *trieNode) replace(child *trieNode) {
+	for i, c := range n.children {
+		if c.prefix[0] == child.prefix[0] {
+			n.children[i] = child
+			return
+		}
+	}
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
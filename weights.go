@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// balancers holds the LoadBalancers of the loaded configuration, by the
+// routeKey of their route, so weights can be adjusted at runtime.
+var balancers = struct {
+	sync.Mutex
+	m map[string][]*LoadBalancer
+}{m: make(map[string][]*LoadBalancer)}
+
+// routeKey names a route in the registry. Routes with Hosts share their
+// Path, so it is prefixed by the Hosts, as api.example.com,*.example.com/api.
+func routeKey(Route Route) string {
+	if len(Route.Hosts) == 0 {
+		return Route.Path
+	}
+	return strings.Join(Route.Hosts, ",") + Route.Path
+}
+
+// registerBalancers replaces the registry, with the balancers of a newly
+// loaded configuration. The backends of the balancers replaced, are
+// removed from their strategies and outlier detectors, handing on their
+// ejections, and those joining a route start slowly.
+func registerBalancers(m map[string][]*LoadBalancer) {
+	balancers.Lock()
+	replaced := balancers.m
+	balancers.m = m
+	balancers.Unlock()
+
+	startJoined(replaced, m)
+	inheritEjections(replaced, m)
+
+	for _, lbs := range replaced {
+		for _, lb := range lbs {
+			for i := 0; i < lb.Count; i++ {
+				lb.Strategy.BackendRemoved(lb, i)
+				if lb.Outlier != nil {
+					lb.Outlier.BackendRemoved(lb, i)
+				}
+			}
+		}
+	}
+}
+
+// smoothWeightedRoundRobin spreads requests by weight, interleaving them
+// rather than sending bursts to the heaviest backend (as in nginx).
+// Backends with weight 0 are drained, and receive nothing, as do unhealthy
+// backends.
+type smoothWeightedRoundRobin struct {
+	StrategyHooks
+	sync.Mutex
+	current [64]int64
+}
+
+func newSmoothWeightedRoundRobin(Route Route) (Strategy, error) {
+	return &smoothWeightedRoundRobin{}, nil
+}
+
+func (s *smoothWeightedRoundRobin) Select(lb *LoadBalancer, req *http.Request) int {
+	s.Lock()
+	defer s.Unlock()
+
+	var total int64
+	best := -1
+	for i := 0; i < lb.Count; i++ {
+		weight := atomic.LoadInt64(&lb.Weights[i])
+		if !lb.Healthy(i) {
+			weight = 0
+		}
+		s.current[i] += weight
+		total += weight
+		if weight > 0 && (best < 0 || s.current[i] > s.current[best]) {
+			best = i
+		}
+	}
+
+	// Everything is drained, fall back on the backends as equals.
+	if best < 0 {
+		return RoundRobinStrategy(lb, req)
+	}
+	s.current[best] -= total
+	return best
+}
+
+// BackendAdded starts the backend afresh, should its position be reused.
+func (s *smoothWeightedRoundRobin) BackendAdded(lb *LoadBalancer, backend int) {
+	s.Lock()
+	defer s.Unlock()
+	s.current[backend] = 0
+}
+
+// SetWeight changes the weight of a backend, returning false if the
+// backend is not in the LoadBalancer.
+func (l *LoadBalancer) SetWeight(backend string, weight int) bool {
+	found := false
+	for i := 0; i < l.Count; i++ {
+		if l.Backends[i] == backend {
+			atomic.StoreInt64(&l.Weights[i], int64(weight))
+			found = true
+		}
+	}
+	if found {
+		atomic.AddInt64(&l.reweighed, 1)
+	}
+	return found
+}
+
+// BackendWeight is a backend and its weight, for the weights-endpoint.
+type BackendWeight struct {
+	Route   string
+	Backend string
+	Weight  int64
+}
+
+// AllWeights returns the weights of every backend, ordered by route.
+func AllWeights() []BackendWeight {
+	balancers.Lock()
+	defer balancers.Unlock()
+
+	weights := make([]BackendWeight, 0)
+	for route, lbs := range balancers.m {
+		for _, lb := range lbs {
+			for i := 0; i < lb.Count; i++ {
+				weights = append(weights, BackendWeight{Route: route,
+					Backend: lb.Backends[i],
+					Weight:  atomic.LoadInt64(&lb.Weights[i])})
+			}
+		}
+	}
+
+	sort.SliceStable(weights, func(i, j int) bool {
+		return weights[i].Route < weights[j].Route
+	})
+	return weights
+}
+
+// WeightsHandler serves the weights as JSON, and sets the weight of a
+// backend on POST, ie. /weights?route=/api&backend=http://b:8080&weight=0,
+// where route is the routeKey. Leaving out route, sets the weight on every
+// route using the backend. Weights set here last until the configuration is
+// reloaded.
+func WeightsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		weight, err := strconv.Atoi(req.FormValue("weight"))
+		if err != nil || weight < 0 {
+			http.Error(res, fmt.Sprintf("Invalid weight %q", req.FormValue("weight")), http.StatusBadRequest)
+			return
+		}
+
+		route, backend := req.FormValue("route"), req.FormValue("backend")
+		found := false
+		balancers.Lock()
+		for key, lbs := range balancers.m {
+			if route != "" && route != key {
+				continue
+			}
+			for _, lb := range lbs {
+				if lb.SetWeight(backend, weight) {
+					found = true
+				}
+			}
+		}
+		balancers.Unlock()
+
+		if !found {
+			http.Error(res, fmt.Sprintf("No backend %q on route %q", backend, route), http.StatusNotFound)
+			return
+		}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(struct {
+		Weights []BackendWeight
+	}{AllWeights()})
+}